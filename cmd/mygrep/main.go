@@ -10,40 +10,188 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
 
+	"github.com/mmarchesotti/build-your-own-grep/internal/ahocorasick"
+	"github.com/mmarchesotti/build-your-own-grep/internal/ast"
+	"github.com/mmarchesotti/build-your-own-grep/internal/backtrack"
 	"github.com/mmarchesotti/build-your-own-grep/internal/buildnfa"
+	"github.com/mmarchesotti/build-your-own-grep/internal/inlineflag"
 	"github.com/mmarchesotti/build-your-own-grep/internal/lexer"
+	"github.com/mmarchesotti/build-your-own-grep/internal/nfa"
 	"github.com/mmarchesotti/build-your-own-grep/internal/nfasimulator"
 	"github.com/mmarchesotti/build-your-own-grep/internal/parser"
+	"github.com/mmarchesotti/build-your-own-grep/internal/token"
 )
 
 const usage = `Usage: mygrep [options] <pattern> [path...]
+       mygrep [options] -e <pattern>... [path...]
+       mygrep [options] -f <file> [path...]
 
 Search for PATTERN in each PATH. If no PATH is provided,
 the search reads from standard input.
 
 Options:
+  -e PATTERN
+        Search for PATTERN. Repeat it to search for several
+        patterns at once; a line matches if any of them does.
+        Also useful for a pattern that starts with '-'.
+  -f FILE
+        Read patterns from FILE, one per line, or from standard
+        input when FILE is '-'. Can be combined with -e.
+  -E    Read PATTERN as an extended regular expression. This is
+        the default unless MYGREP_SYNTAX is set to "basic" or
+        "fixed".
+  -G    Read PATTERN as a basic regular expression, where \( \)
+        \{ \} \| \+ and \? are the operators.
+  -F, --fixed-strings
+        Read PATTERN as a list of fixed strings, one per line, and
+        match lines that contain any of them.
   -r    Recursively search subdirectories. When this flag is used,
         the trailing path must be a single directory.
+  -i, --ignore-case
+        Match letters regardless of case.
+  -S, --smart-case
+        Match letters regardless of case, unless the pattern
+        contains an uppercase letter.
+  --dotall
+        Let '.' match a newline as well.
+  -X, --extended
+        Ignore unescaped whitespace in the pattern, and treat '#'
+        as the start of a comment up to the end of the line.
+  --posix
+        Report the leftmost-longest match, with POSIX rules for
+        the captures, instead of the one the pattern prefers.
+  --max-recursion N
+        Fail a match that nests more than N recursive patterns or
+        subroutine calls (default 1000).
 
 Examples:
   mygrep 'apple' file1.txt file2.txt
   cat file.txt | mygrep 'apple'
   mygrep -r 'apple' ./my_project`
 
+// syntax is the regular expression dialect a pattern is read in.
+type syntax int
+
+const (
+	syntaxExtended syntax = iota
+	syntaxBasic
+	// syntaxFixed reads the pattern as newline-separated literal strings.
+	syntaxFixed
+)
+
+// syntaxEnv names the environment variable that sets the syntax used when
+// neither -E nor -G is given.
+const syntaxEnv = "MYGREP_SYNTAX"
+
+// defaultSyntax returns the syntax selected by syntaxEnv, which may be
+// "extended", "basic" or "fixed". Extended syntax is the default when it is
+// unset.
+func defaultSyntax() (syntax, error) {
+	switch value := os.Getenv(syntaxEnv); value {
+	case "", "extended":
+		return syntaxExtended, nil
+	case "basic":
+		return syntaxBasic, nil
+	case "fixed":
+		return syntaxFixed, nil
+	default:
+		return syntaxExtended, fmt.Errorf("invalid %s %q: want \"basic\", \"extended\" or \"fixed\"", syntaxEnv, value)
+	}
+}
+
+// options holds the command-line settings that change how the pattern is
+// compiled.
+type options struct {
+	syntax     syntax
+	ignoreCase bool
+	smartCase  bool
+	dotAll     bool
+	extended   bool
+	// posix selects leftmost-longest match semantics.
+	posix bool
+	// maxRecursion limits how deeply subroutine calls and recursion may
+	// nest.
+	maxRecursion int
+}
+
 func main() {
+	var opts options
+	var err error
+	opts.syntax, err = defaultSyntax()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
+	}
+	// patterns collects the -e and -f patterns. Without either, the first
+	// argument is the pattern.
+	var patterns []string
+	patternsGiven := false
+	flag.Func("e", "Pattern to search for (repeatable)", func(pattern string) error {
+		patterns = append(patterns, pattern)
+		patternsGiven = true
+		return nil
+	})
+	flag.Func("f", "File to read patterns from, one per line ('-' for stdin)", func(path string) error {
+		filePatterns, err := readPatternFile(path)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, filePatterns...)
+		patternsGiven = true
+		return nil
+	})
+	flag.BoolFunc("E", "Extended regular expression syntax", func(string) error {
+		opts.syntax = syntaxExtended
+		return nil
+	})
+	flag.BoolFunc("G", "Basic regular expression syntax", func(string) error {
+		opts.syntax = syntaxBasic
+		return nil
+	})
+	fixedStrings := func(string) error {
+		opts.syntax = syntaxFixed
+		return nil
+	}
+	flag.BoolFunc("F", "Fixed strings", fixedStrings)
+	flag.BoolFunc("fixed-strings", "Fixed strings", fixedStrings)
 	recursive := flag.Bool("r", false, "Recursive search")
+	flag.BoolVar(&opts.ignoreCase, "i", false, "Case-insensitive search")
+	flag.BoolVar(&opts.ignoreCase, "ignore-case", false, "Case-insensitive search")
+	flag.BoolVar(&opts.smartCase, "S", false, "Case-insensitive search unless the pattern has uppercase letters")
+	flag.BoolVar(&opts.smartCase, "smart-case", false, "Case-insensitive search unless the pattern has uppercase letters")
+	flag.BoolVar(&opts.dotAll, "dotall", false, "Let '.' match a newline")
+	flag.BoolVar(&opts.extended, "X", false, "Ignore whitespace and # comments in the pattern")
+	flag.BoolVar(&opts.extended, "extended", false, "Ignore whitespace and # comments in the pattern")
+	flag.BoolVar(&opts.posix, "posix", false, "Report the leftmost-longest match, as POSIX tools do")
+	flag.IntVar(&opts.maxRecursion, "max-recursion", nfasimulator.DefaultMaxRecursionDepth, "Maximum nesting of recursion and subroutine calls")
 	flag.Parse()
 
-	args := flag.Args()
-	if len(args) < 1 {
-		fmt.Fprintln(os.Stderr, "error: missing pattern")
-		fmt.Fprintln(os.Stderr, usage)
+	if opts.maxRecursion < 0 {
+		fmt.Fprintln(os.Stderr, "error: --max-recursion must not be negative")
 		os.Exit(2)
 	}
 
-	pattern := args[0]
-	paths := args[1:]
+	args := flag.Args()
+	if !patternsGiven {
+		if len(args) < 1 {
+			fmt.Fprintln(os.Stderr, "error: missing pattern")
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		patterns = []string{args[0]}
+		args = args[1:]
+	}
+	paths := args
+
+	compiled, err := compilePatterns(patterns, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
+	}
 
 	matchFound := false
 	var filenames []string
@@ -75,7 +223,7 @@ func main() {
 	}
 
 	if len(filenames) == 0 {
-		hasMatch, matchedLines, err := processLines(os.Stdin, pattern)
+		hasMatch, matchedLines, err := processLines(os.Stdin, compiled)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			os.Exit(2)
@@ -105,7 +253,7 @@ func main() {
 				err = errors.Join(err, file.Close())
 			}()
 
-			hasMatch, matchedLines, err := processLines(file, pattern)
+			hasMatch, matchedLines, err := processLines(file, compiled)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "error: %v\n", err)
 				os.Exit(2)
@@ -134,7 +282,32 @@ func main() {
 	}
 }
 
-func processLines(input io.Reader, pattern string) (bool, [][]byte, error) {
+// readPatternFile returns the patterns in the file at path, one per line.
+// The path '-' stands for standard input.
+func readPatternFile(path string) (patterns []string, err error) {
+	input := io.Reader(os.Stdin)
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			err = errors.Join(err, file.Close())
+		}()
+		input = file
+	}
+
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading patterns: %w", err)
+	}
+	return patterns, nil
+}
+
+func processLines(input io.Reader, compiled *compiledPatterns) (bool, [][]byte, error) {
 	scanner := bufio.NewScanner(input)
 	anyMatchFound := false
 
@@ -144,7 +317,7 @@ func processLines(input io.Reader, pattern string) (bool, [][]byte, error) {
 		lineCopy := make([]byte, len(line))
 		copy(lineCopy, line)
 
-		ok, err := matchLine(lineCopy, pattern)
+		ok, err := compiled.match(lineCopy)
 		if err != nil {
 			return false, nil, err
 		}
@@ -162,28 +335,178 @@ func processLines(input io.Reader, pattern string) (bool, [][]byte, error) {
 	return anyMatchFound, matchedLines, nil
 }
 
-func matchLine(lineCopy []byte, pattern string) (bool, error) {
-	tokens, err := lexer.Tokenize(pattern)
+func matchLine(lineCopy []byte, pattern string, opts options) (bool, error) {
+	compiled, err := compilePatterns([]string{pattern}, opts)
 	if err != nil {
 		return false, err
 	}
+	return compiled.match(lineCopy)
+}
 
-	tree, captureCount, err := parser.Parse(tokens)
-	if err != nil {
-		return false, err
+// compiledPatterns holds the patterns of a search, compiled once for every
+// line it reads.
+type compiledPatterns struct {
+	// fixed is the automaton for fixed-string mode, which builds no NFA.
+	fixed *ahocorasick.Automaton
+	// fragment joins the NFAs of all the patterns. Its Start is nil when
+	// there are no patterns, and then no line matches.
+	fragment     nfa.Fragment
+	captureCount int
+	// backtrack is set when any pattern has a backreference or a
+	// subroutine call, which the memoized simulation cannot handle.
+	backtrack    bool
+	maxRecursion int
+	semantics    nfasimulator.Semantics
+}
+
+// compilePatterns compiles the patterns into a single matcher, so that each
+// line is scanned once however many patterns there are.
+func compilePatterns(patterns []string, opts options) (*compiledPatterns, error) {
+	if opts.syntax == syntaxFixed {
+		return &compiledPatterns{fixed: newFixedStringMatcher(patterns, opts)}, nil
 	}
 
-	fragment, err := buildnfa.Build(tree)
-	if err != nil {
-		return false, err
+	compiled := &compiledPatterns{maxRecursion: opts.maxRecursion}
+	if opts.posix {
+		compiled.semantics = nfasimulator.LeftmostLongest
+	}
+	if len(patterns) == 0 {
+		return compiled, nil
+	}
+
+	tokenized := make([][]token.Token, 0, len(patterns))
+	for _, pattern := range patterns {
+		tokens, err := tokenizePattern(pattern, opts)
+		if err != nil {
+			return nil, err
+		}
+		tokenized = append(tokenized, tokens)
+	}
+	// Smart case looks at all the patterns together, as in fixed-string
+	// mode, so that a line matches the same way whichever mode it is in.
+	caseInsensitive := isCaseInsensitive(opts, slices.ContainsFunc(tokenized, hasUppercaseLiteral))
+
+	var trees []ast.ASTNode
+	for _, tokens := range tokenized {
+		tokens = addModeFlags(tokens, opts, caseInsensitive)
+		if slices.ContainsFunc(tokens, token.IsBackReference) || slices.ContainsFunc(tokens, token.IsSubroutineCall) {
+			compiled.backtrack = true
+		}
+
+		tree, captureCount, err := parser.Parse(tokens)
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, tree)
+		compiled.captureCount = max(compiled.captureCount, captureCount)
 	}
 
-	captures, err := nfasimulator.Simulate(lineCopy, fragment, captureCount)
+	fragment, err := buildnfa.BuildAll(trees)
 	if err != nil {
-		return false, fmt.Errorf("invalid pattern: %w", err)
+		return nil, err
+	}
+	compiled.fragment = fragment
+
+	return compiled, nil
+}
+
+// tokenizePattern tokenizes one pattern in the syntax chosen by opts.
+func tokenizePattern(pattern string, opts options) ([]token.Token, error) {
+	// Extended syntax changes how the pattern is split into tokens, so it
+	// has to be known by the lexer rather than added as a token afterwards.
+	var lexerFlags inlineflag.Flags
+	if opts.extended {
+		lexerFlags = inlineflag.Extended
+	}
+	tokenize := lexer.TokenizeWithFlags
+	if opts.syntax == syntaxBasic {
+		tokenize = lexer.TokenizeBasic
+	}
+	return tokenize(pattern, lexerFlags)
+}
+
+// addModeFlags adds the inline flags the command-line options stand for at
+// the start of a pattern, so the pattern can still switch them off with
+// (?-flags). Whether case is ignored is decided by the caller.
+func addModeFlags(tokens []token.Token, opts options, caseInsensitive bool) []token.Token {
+	var flags inlineflag.Flags
+	if caseInsensitive {
+		flags |= inlineflag.CaseInsensitive
 	}
+	if opts.dotAll {
+		flags |= inlineflag.DotAll
+	}
+	if flags != 0 {
+		tokens = slices.Insert(tokens, 0, token.Token(&token.InlineFlags{On: flags}))
+	}
+	return tokens
+}
+
+// isCaseInsensitive reports whether case is ignored, given whether any of the
+// patterns has an uppercase letter. Smart case ignores it unless one does.
+func isCaseInsensitive(opts options, hasUppercase bool) bool {
+	return opts.ignoreCase || (opts.smartCase && !hasUppercase)
+}
+
+func (c *compiledPatterns) match(line []byte) (bool, error) {
+	switch {
+	case c.fixed != nil:
+		return c.fixed.Match(line), nil
+	case c.fragment.Start == nil:
+		return false, nil
+	case c.backtrack:
+		return backtrack.Match(line, c.fragment, c.captureCount, c.maxRecursion, c.semantics), nil
+	}
+
+	captures := nfasimulator.First(line, c.fragment, c.captureCount, c.semantics)
+	return captures != nil, nil
+}
+
+// newFixedStringMatcher builds the automaton for fixed-string mode, where
+// every line of every pattern is a string to search for. Fixed strings
+// bypass the regular expression pipeline entirely, so only the case options
+// apply to them, and smart case looks at all the strings together.
+func newFixedStringMatcher(patterns []string, opts options) *ahocorasick.Automaton {
+	var needles []string
+	for _, pattern := range patterns {
+		needles = append(needles, strings.Split(pattern, "\n")...)
+	}
+	hasUppercase := slices.ContainsFunc(needles, func(needle string) bool {
+		return strings.ContainsFunc(needle, unicode.IsUpper)
+	})
+	return ahocorasick.New(needles, isCaseInsensitive(opts, hasUppercase))
+}
 
-	_, hasMatch := <-captures
+// hasUppercaseLiteral reports whether any literal in the pattern, inside or
+// outside a character set, is an uppercase letter. Escapes such as \W and
+// \P{Lu} do not count.
+func hasUppercaseLiteral(tokens []token.Token) bool {
+	for _, t := range tokens {
+		switch t := t.(type) {
+		case *token.Literal:
+			if unicode.IsUpper(t.Literal) {
+				return true
+			}
+		case *token.CharacterSet:
+			if setHasUppercaseLiteral(t) {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	return hasMatch, nil
+// setHasUppercaseLiteral reports whether a bracket expression, or any of
+// the operands of its && and -- operators, lists an uppercase letter.
+func setHasUppercaseLiteral(set *token.CharacterSet) bool {
+	if slices.ContainsFunc(set.Literals, unicode.IsUpper) {
+		return true
+	}
+	for _, rng := range set.Ranges {
+		if unicode.IsUpper(rng[0]) || unicode.IsUpper(rng[1]) {
+			return true
+		}
+	}
+	return slices.ContainsFunc(set.Intersect, setHasUppercaseLiteral) ||
+		slices.ContainsFunc(set.Subtract, setHasUppercaseLiteral)
 }
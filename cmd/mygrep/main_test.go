@@ -5,6 +5,8 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/mmarchesotti/build-your-own-grep/internal/buildnfa"
@@ -16,29 +18,41 @@ import (
 // helper function to encapsulate the Lex -> Parse -> Build -> Simulate pipeline
 // used in the main.go logic.
 func compileAndMatch(line []byte, pattern string) (bool, []nfasimulator.Capture, error) {
+	matches, err := compileAndFindAll(line, pattern, nfasimulator.LeftmostFirst)
+	if err != nil || len(matches) == 0 {
+		return false, nil, err
+	}
+	return true, matches[0], nil
+}
+
+// compileAndFindAll runs the same pipeline as compileAndMatch, and returns the
+// captures of every match the simulation reports.
+func compileAndFindAll(line []byte, pattern string, semantics nfasimulator.Semantics) ([][]nfasimulator.Capture, error) {
 	tokens, err := lexer.Tokenize(pattern)
 	if err != nil {
-		return false, nil, err
+		return nil, err
 	}
 
 	tree, captureCount, err := parser.Parse(tokens)
 	if err != nil {
-		return false, nil, err
+		return nil, err
 	}
 
 	fragment, err := buildnfa.Build(tree)
 	if err != nil {
-		return false, nil, err
+		return nil, err
 	}
 
-	capturesChan, err := nfasimulator.Simulate(line, fragment, captureCount)
+	capturesChan, err := nfasimulator.Simulate(line, fragment, captureCount, semantics)
 	if err != nil {
-		return false, nil, err
+		return nil, err
 	}
 
-	// Read from the channel to get the result
-	capturedSlice, ok := <-capturesChan
-	return ok, capturedSlice, nil
+	var matches [][]nfasimulator.Capture
+	for captures := range capturesChan {
+		matches = append(matches, captures)
+	}
+	return matches, nil
 }
 
 func TestMatchLine(t *testing.T) {
@@ -87,6 +101,114 @@ func TestMatchLine(t *testing.T) {
 			line: []byte("$#%"), pattern: `\w`,
 			expectedMatch: false,
 		},
+		// Whitespace '\s' and negated classes
+		{
+			name: `Whitespace (\s): Match tab`,
+			line: []byte("key\tvalue"), pattern: `key\s+value`,
+			expectedMatch: true,
+		},
+		{
+			name: `Whitespace (\s): No match`,
+			line: []byte("keyvalue"), pattern: `key\svalue`,
+			expectedMatch: false,
+		},
+		{
+			name: `Non-digit (\D): Match`,
+			line: []byte("123a456"), pattern: `\d\D\d`,
+			expectedMatch: true,
+		},
+		{
+			name: `Non-alphanumeric (\W): No match`,
+			line: []byte("abc_123"), pattern: `\W`,
+			expectedMatch: false,
+		},
+		{
+			name: `Non-whitespace (\S): Match`,
+			line: []byte("  x  "), pattern: `\S`,
+			expectedMatch: true,
+		},
+		{
+			name: `Whitespace in group: Match separator`,
+			line: []byte("a;b"), pattern: `a[\s,;]b`,
+			expectedMatch: true,
+		},
+		{
+			name: `Negated class in group: Match`,
+			line: []byte("a b"), pattern: `^[\S]+ [\D]$`,
+			expectedMatch: true,
+		},
+		// POSIX bracket classes
+		{
+			name: "POSIX Class: Digits",
+			line: []byte("year 2024"), pattern: `[[:digit:]]{4}`,
+			expectedMatch: true,
+		},
+		{
+			name: "POSIX Class: Upper fails on lowercase",
+			line: []byte("lowercase"), pattern: `[[:upper:]]`,
+			expectedMatch: false,
+		},
+		{
+			name: "POSIX Class: Punctuation",
+			line: []byte("hello, world"), pattern: `o[[:punct:]]`,
+			expectedMatch: true,
+		},
+		{
+			name: "POSIX Class: Combined with literal",
+			line: []byte("snake_case"), pattern: `^[[:lower:]_]+$`,
+			expectedMatch: true,
+		},
+		{
+			name: "POSIX Class: Negated space",
+			line: []byte("   "), pattern: `[^[:space:]]`,
+			expectedMatch: false,
+		},
+		{
+			name: "POSIX Class: Hex digits",
+			line: []byte("0x1F"), pattern: `0x[[:xdigit:]]+$`,
+			expectedMatch: true,
+		},
+		// Set operations
+		{
+			name: "Set Intersection: Consonant",
+			line: []byte("b"), pattern: `^[a-z&&[^aeiou]]$`,
+			expectedMatch: true,
+		},
+		{
+			name: "Set Intersection: Vowel is excluded",
+			line: []byte("e"), pattern: `^[a-z&&[^aeiou]]$`,
+			expectedMatch: false,
+		},
+		{
+			name: "Set Subtraction: Word character that is not a digit",
+			line: []byte("x"), pattern: `^[\w--\d]$`,
+			expectedMatch: true,
+		},
+		{
+			name: "Set Subtraction: Digit is excluded",
+			line: []byte("5"), pattern: `^[\w--\d]$`,
+			expectedMatch: false,
+		},
+		{
+			name: "Set Subtraction: Confusable letters",
+			line: []byte("Il10O"), pattern: `[[:alnum:]--[Il1O0]]`,
+			expectedMatch: false,
+		},
+		{
+			name: "Set Operations: Chained left to right",
+			line: []byte("c"), pattern: `^[a-z&&b-e&&c-f--d]$`,
+			expectedMatch: true,
+		},
+		{
+			name: "Set Operations: Negation applies to the result",
+			line: []byte("c"), pattern: `^[^a-z--c]$`,
+			expectedMatch: true,
+		},
+		{
+			name: "Set Operations: Case-insensitive",
+			line: []byte("E"), pattern: `(?i)^[a-z&&[^aeiou]]$`,
+			expectedMatch: false,
+		},
 		// Start Anchor '^'
 		{
 			name: "Start Anchor (^): Match at beginning",
@@ -131,142 +253,1582 @@ func TestMatchLine(t *testing.T) {
 			line: []byte("xyz"), pattern: "[^xyz]",
 			expectedMatch: false,
 		},
-		// Combination of patterns
+		// Ranges inside character groups
 		{
-			name: "Combination: Match a literal and a digit",
-			line: []byte("a1c"), pattern: `a\d`,
+			name: "Range Group: Match inside range",
+			line: []byte("--m--"), pattern: "[a-z]",
 			expectedMatch: true,
 		},
 		{
-			name: "Combination: Fails on wrong order",
-			line: []byte("1ac"), pattern: `a\d`,
+			name: "Range Group: Dash is not a member",
+			line: []byte("-"), pattern: "[a-z]",
 			expectedMatch: false,
 		},
-		// Match one or more times
 		{
-			name: "Match one or more times: Match triple letter a in the middle of word",
-			line: []byte("caaats"), pattern: `ca+ts`,
+			name: "Range Group: Negated range",
+			line: []byte("ABCDEF"), pattern: "[^A-F]",
+			expectedMatch: false,
+		},
+		{
+			name: "Range Group: Trailing dash is literal",
+			line: []byte("x-y"), pattern: "x[0-9-]y",
 			expectedMatch: true,
 		},
 		{
-			name: "Match one or more times: Match triple letter a in the end of word",
-			line: []byte("caaa"), pattern: `ca+`,
+			name: "Range Group: Closing bracket as first member",
+			line: []byte("a]b"), pattern: "a[]]b",
 			expectedMatch: true,
 		},
+		// Non-ASCII patterns
 		{
-			name: "Match one or more times: Fails on no character matching",
-			line: []byte("caat"), pattern: `cat+`,
+			name: "UTF-8: Multi-byte literal",
+			line: []byte("un café noir"), pattern: "café",
+			expectedMatch: true,
+		},
+		{
+			name: "UTF-8: Multi-byte character set",
+			line: []byte("schön"), pattern: "sch[äöü]n",
+			expectedMatch: true,
+		},
+		{
+			name: "UTF-8: Wildcard consumes a whole rune",
+			line: []byte("naïve"), pattern: "^na.ve$",
+			expectedMatch: true,
+		},
+		{
+			name: "UTF-8: Multi-byte range",
+			line: []byte("λόγος"), pattern: "^[α-ω]",
+			expectedMatch: true,
+		},
+		// Unicode property classes
+		{
+			name: `Unicode Property (\p{L}): Any letter`,
+			line: []byte("Grüße"), pattern: `^\p{L}+$`,
+			expectedMatch: true,
+		},
+		{
+			name: `Unicode Property (\p{Lu}): No uppercase`,
+			line: []byte("ελληνικά"), pattern: `\p{Lu}`,
 			expectedMatch: false,
 		},
 		{
-			name: "Match one or more times: codecrafters #02",
-			line: []byte("caaats"), pattern: `ca+at`,
+			name: `Unicode Property (\p{Greek}): Script`,
+			line: []byte("word λόγος"), pattern: `\p{Greek}+`,
 			expectedMatch: true,
 		},
-	}
-
-	for _, tc := range basicTestCases {
-		t.Run(tc.name, func(t *testing.T) {
-			// Use the helper to process the pipeline
-			actualMatch, _, err := compileAndMatch(tc.line, tc.pattern)
-			if err != nil {
-				t.Errorf("error '%s':", err)
-			}
-
-			if actualMatch != tc.expectedMatch {
-				t.Errorf("Pattern '%s' on line '%s': expected match %v, but got %v",
-					tc.pattern, string(tc.line), tc.expectedMatch, actualMatch)
-			}
-		})
-	}
-
-	// --- Test cases specifically for validating captures ---
-	captureTestCases := []struct {
-		name             string
-		line             []byte
-		pattern          string
-		expectedMatch    bool
-		expectedCaptures []nfasimulator.Capture
-	}{
 		{
-			name:          "Captures: Single simple group",
-			line:          []byte("hello world"),
-			pattern:       "w(o)rld",
+			name: `Unicode Property (\p{Han}): In set`,
+			line: []byte("id: 漢字"), pattern: `[\p{Han}\d]`,
 			expectedMatch: true,
-			expectedCaptures: []nfasimulator.Capture{
-				{Start: 6, End: 11}, // "world"
-				{Start: 7, End: 8},  // "o"
-			},
 		},
 		{
-			name:          "Captures: Full string match",
-			line:          []byte("abc"),
-			pattern:       "(abc)",
+			name: `Unicode Property (\P{L}): Negated`,
+			line: []byte("abcé"), pattern: `\P{L}`,
+			expectedMatch: false,
+		},
+		// Atomic groups and possessive quantifiers
+		{
+			name: "Atomic Group: Does not give back characters",
+			line: []byte("aaa"), pattern: `(?>a+)a`,
+			expectedMatch: false,
+		},
+		{
+			name: "Atomic Group: Commits to the first alternative",
+			line: []byte("abc"), pattern: `(?>a|ab)c`,
+			expectedMatch: false,
+		},
+		{
+			name: "Atomic Group: Tries later alternatives before committing",
+			line: []byte("ac"), pattern: `(?>ab|a)c`,
 			expectedMatch: true,
-			expectedCaptures: []nfasimulator.Capture{
-				{Start: 0, End: 3}, // "abc"
-				{Start: 0, End: 3}, // "abc"
-			},
 		},
 		{
-			name:          "Captures: Nested groups",
-			line:          []byte("axbyc"),
-			pattern:       "a(x(b)y)c",
+			name: "Possessive Star: Does not give back characters",
+			line: []byte(`"abc"`), pattern: `"[^\n]*+"`,
+			expectedMatch: false,
+		},
+		{
+			name: "Possessive Plus: Matches when nothing needs to be given back",
+			line: []byte("12345x"), pattern: `^\d++x`,
 			expectedMatch: true,
-			expectedCaptures: []nfasimulator.Capture{
-				{Start: 0, End: 5}, // "axbyc"
-				{Start: 1, End: 4}, // "xby"
-				{Start: 2, End: 3}, // "b"
-			},
 		},
 		{
-			name:             "Captures: No match, no captures",
-			line:             []byte("zzzzz"),
-			pattern:          "(a)",
-			expectedMatch:    false,
-			expectedCaptures: nil,
+			name: "Possessive Optional: Keeps the optional character",
+			line: []byte("ab"), pattern: `^a?+ab`,
+			expectedMatch: false,
 		},
+		// Lookaround assertions
 		{
-			name:          "Captures: Plus quantifier",
-			line:          []byte("abbbc"),
-			pattern:       "a(b+)c",
+			name: "Lookahead: Followed by",
+			line: []byte("price: 100 USD"), pattern: `\d+(?= USD)`,
 			expectedMatch: true,
-			expectedCaptures: []nfasimulator.Capture{
-				{Start: 0, End: 5}, // "abbbc"
-				{Start: 1, End: 4}, // "bbb"
-			},
 		},
 		{
-			name:          "Captures: Group with quantifier",
-			line:          []byte("ababab"),
-			pattern:       "(ab)+",
+			name: "Negative Lookahead: Placeholder is rejected",
+			line: []byte("password=<changeme>"), pattern: `password=(?!<changeme>)`,
+			expectedMatch: false,
+		},
+		{
+			name: "Negative Lookahead: Real value is reported",
+			line: []byte("password=hunter2"), pattern: `password=(?!<changeme>)`,
 			expectedMatch: true,
-			expectedCaptures: []nfasimulator.Capture{
-				{Start: 0, End: 6}, // "ababab"
-				{Start: 4, End: 6}, // "ab"
-			},
 		},
-	}
-
-	for _, tc := range captureTestCases {
-		t.Run(tc.name, func(t *testing.T) {
-			actualMatch, actualCaptures, err := compileAndMatch(tc.line, tc.pattern)
-			if err != nil {
-				t.Errorf("error '%s':", err)
-			}
-
-			if actualMatch != tc.expectedMatch {
-				t.Errorf("Pattern '%s' on line '%s': expected match %v, but got %v",
-					tc.pattern, string(tc.line), tc.expectedMatch, actualMatch)
-			}
-
-			// For captures, we need to check the actual data returned from the channel
-			if !reflect.DeepEqual(actualCaptures, tc.expectedCaptures) {
-				t.Errorf("Pattern '%s' on line '%s': incorrect captures", tc.pattern, string(tc.line))
-				t.Errorf("  got: %v", actualCaptures)
-				t.Errorf(" want: %v", tc.expectedCaptures)
-			}
-		})
+		{
+			name: "Lookbehind: Preceded by currency sign",
+			line: []byte("total €42"), pattern: `(?<=€)\d+`,
+			expectedMatch: true,
+		},
+		{
+			name: "Lookbehind: Not preceded by currency sign",
+			line: []byte("total 42"), pattern: `(?<=[$€])\d+`,
+			expectedMatch: false,
+		},
+		{
+			name: "Negative Lookbehind: Rejects preceded match",
+			line: []byte("$5"), pattern: `(?<!\$)5`,
+			expectedMatch: false,
+		},
+		{
+			name: "Lookbehind: Variable but bounded length",
+			line: []byte("USD 5"), pattern: `(?<=(USD|€) ?)5`,
+			expectedMatch: true,
+		},
+		{
+			name: "Lookbehind: Can see the start of the line",
+			line: []byte("ab"), pattern: `(?<=^a)b`,
+			expectedMatch: true,
+		},
+		{
+			name: "Escapes: Tab-separated fields",
+			line: []byte("id\tname\tage"), pattern: `^\w+\tname\t`,
+			expectedMatch: true,
+		},
+		{
+			name: "Escapes: Tab does not match the letter t",
+			line: []byte("t"), pattern: `\t`,
+			expectedMatch: false,
+		},
+		{
+			name: "Escapes: Hexadecimal code point",
+			line: []byte("price: €5"), pattern: `\x{20AC}\d`,
+			expectedMatch: true,
+		},
+		{
+			name: "Escapes: Quoted metacharacters",
+			line: []byte("call f(x) now"), pattern: `\Qf(x)\E now`,
+			expectedMatch: true,
+		},
+		{
+			name: "Escapes: Quoted metacharacters are not operators",
+			line: []byte("aaa"), pattern: `\Qa+\E`,
+			expectedMatch: false,
+		},
+		{
+			name: "Inline Flags: Case-insensitive literal",
+			line: []byte("ERROR: disk full"), pattern: `(?i)error`,
+			expectedMatch: true,
+		},
+		{
+			name: "Inline Flags: Case-insensitive range",
+			line: []byte("0XFF"), pattern: `(?i)0x[a-f]+`,
+			expectedMatch: true,
+		},
+		{
+			name: "Inline Flags: Case-insensitive negated set",
+			line: []byte("A"), pattern: `(?i)[^a]`,
+			expectedMatch: false,
+		},
+		{
+			name: "Inline Flags: Unicode simple folding",
+			line: []byte("ΣΟΦΟΣ"), pattern: `(?i)σοφος`,
+			expectedMatch: true,
+		},
+		{
+			name: "Inline Flags: Scoped to a subgroup",
+			line: []byte("Abc"), pattern: `(?i:a)bc`,
+			expectedMatch: true,
+		},
+		{
+			name: "Inline Flags: Subgroup scope ends at its closer",
+			line: []byte("ABC"), pattern: `(?i:a)bc`,
+			expectedMatch: false,
+		},
+		{
+			name: "Inline Flags: Apply to the rest of the enclosing group",
+			line: []byte("aBC"), pattern: `(a(?i)b)c`,
+			expectedMatch: false,
+		},
+		{
+			name: "Inline Flags: Apply across later alternatives",
+			line: []byte("C"), pattern: `a(?i)b|c`,
+			expectedMatch: true,
+		},
+		{
+			name: "Inline Flags: Switched off",
+			line: []byte("aB"), pattern: `(?i)a(?-i)b`,
+			expectedMatch: false,
+		},
+		{
+			name: "Inline Flags: Multiline anchors match around newlines",
+			line: []byte("first\nsecond"), pattern: `(?m)^second$`,
+			expectedMatch: true,
+		},
+		{
+			name: "Inline Flags: Anchors ignore newlines by default",
+			line: []byte("first\nsecond"), pattern: `^second`,
+			expectedMatch: false,
+		},
+		{
+			name: "Multiline: End anchor before a newline",
+			line: []byte("first\nsecond"), pattern: `(?m)first$`,
+			expectedMatch: true,
+		},
+		{
+			name: "Multiline: Start anchor after a newline",
+			line: []byte("a\nb\nc"), pattern: `(?m)^b$`,
+			expectedMatch: true,
+		},
+		{
+			name: "Absolute Anchors: \\A ignores multiline mode",
+			line: []byte("first\nsecond"), pattern: `(?m)\Asecond`,
+			expectedMatch: false,
+		},
+		{
+			name: "Absolute Anchors: \\A at the start",
+			line: []byte("first\nsecond"), pattern: `\Afirst`,
+			expectedMatch: true,
+		},
+		{
+			name: "Absolute Anchors: \\z ignores multiline mode",
+			line: []byte("first\nsecond"), pattern: `(?m)first\z`,
+			expectedMatch: false,
+		},
+		{
+			name: "Absolute Anchors: \\z at the very end",
+			line: []byte("first\nsecond"), pattern: `second\z`,
+			expectedMatch: true,
+		},
+		{
+			name: "Absolute Anchors: \\z rejects a trailing newline",
+			line: []byte("last\n"), pattern: `last\z`,
+			expectedMatch: false,
+		},
+		{
+			name: "Absolute Anchors: \\Z allows a trailing newline",
+			line: []byte("last\n"), pattern: `last\Z`,
+			expectedMatch: true,
+		},
+		{
+			name: "Absolute Anchors: \\Z rejects an inner newline",
+			line: []byte("first\nsecond"), pattern: `first\Z`,
+			expectedMatch: false,
+		},
+		{
+			name: "Inline Flags: Dot-all wildcard matches newline",
+			line: []byte("a\nb"), pattern: `(?s)a.b`,
+			expectedMatch: true,
+		},
+		{
+			name: "Inline Flags: Wildcard skips newline by default",
+			line: []byte("a\nb"), pattern: `a.b`,
+			expectedMatch: false,
+		},
+		{
+			name: "Inline Flags: Extended syntax",
+			line: []byte("2024-01-31"), pattern: "(?x) \\d{4} - \\d{2} - \\d{2}  # ISO date",
+			expectedMatch: true,
+		},
+		{
+			name: "Conditional: Quoted value",
+			line: []byte(`key="value"`), pattern: `^key=(")?\w+(?(1)")$`,
+			expectedMatch: true,
+		},
+		{
+			name: "Conditional: Unquoted value",
+			line: []byte(`key=value`), pattern: `^key=(")?\w+(?(1)")$`,
+			expectedMatch: true,
+		},
+		{
+			name: "Conditional: Unbalanced opening quote",
+			line: []byte(`key="value`), pattern: `^key=(")?\w+(?(1)")$`,
+			expectedMatch: false,
+		},
+		{
+			name: "Conditional: Unbalanced closing quote",
+			line: []byte(`key=value"`), pattern: `^key=(")?\w+(?(1)")$`,
+			expectedMatch: false,
+		},
+		{
+			name: "Conditional: Named group and no branch",
+			line: []byte("(x)"), pattern: `^(?<open>\()?x(?(<open>)\)|;)$`,
+			expectedMatch: true,
+		},
+		{
+			name: "Conditional: Named group takes no branch",
+			line: []byte("x;"), pattern: `^(?<open>\()?x(?(<open>)\)|;)$`,
+			expectedMatch: true,
+		},
+		{
+			name: "Conditional: Same position reached with and without the group",
+			line: []byte("ay"), pattern: `^(?:(a)|a)(?(1)x|y)$`,
+			expectedMatch: true,
+		},
+		{
+			name: "Word Boundary: Whole word",
+			line: []byte("a cat sat"), pattern: `\bcat\b`,
+			expectedMatch: true,
+		},
+		{
+			name: "Word Boundary: Rejects word inside another word",
+			line: []byte("concatenate"), pattern: `\bcat\b`,
+			expectedMatch: false,
+		},
+		{
+			name: "Non-Word Boundary: Inside a word",
+			line: []byte("concatenate"), pattern: `\Bcat\B`,
+			expectedMatch: true,
+		},
+		{
+			name: "Word Boundary: At line edges",
+			line: []byte("cat"), pattern: `\bcat\b`,
+			expectedMatch: true,
+		},
+		{
+			name: "Word Start: Start of a word only",
+			line: []byte("scat cat"), pattern: `\<cat`,
+			expectedMatch: true,
+		},
+		{
+			name: "Word Start: Rejects the end of a word",
+			line: []byte("scat"), pattern: `\<cat`,
+			expectedMatch: false,
+		},
+		{
+			name: "Word End: Rejects the middle of a word",
+			line: []byte("cats"), pattern: `cat\>`,
+			expectedMatch: false,
+		},
+		{
+			name: "Word End: Followed by punctuation",
+			line: []byte("a cat."), pattern: `cat\>`,
+			expectedMatch: true,
+		},
+		{
+			name: "Lookahead: Does not consume input",
+			line: []byte("abc"), pattern: `a(?=b)bc`,
+			expectedMatch: true,
+		},
+		// Combination of patterns
+		{
+			name: "Combination: Match a literal and a digit",
+			line: []byte("a1c"), pattern: `a\d`,
+			expectedMatch: true,
+		},
+		{
+			name: "Combination: Fails on wrong order",
+			line: []byte("1ac"), pattern: `a\d`,
+			expectedMatch: false,
+		},
+		// Match one or more times
+		{
+			name: "Match one or more times: Match triple letter a in the middle of word",
+			line: []byte("caaats"), pattern: `ca+ts`,
+			expectedMatch: true,
+		},
+		{
+			name: "Match one or more times: Match triple letter a in the end of word",
+			line: []byte("caaa"), pattern: `ca+`,
+			expectedMatch: true,
+		},
+		{
+			name: "Match one or more times: Fails on no character matching",
+			line: []byte("caat"), pattern: `cat+`,
+			expectedMatch: false,
+		},
+		{
+			name: "Match one or more times: codecrafters #02",
+			line: []byte("caaats"), pattern: `ca+at`,
+			expectedMatch: true,
+		},
+		// Counted repetition '{n,m}'
+		{
+			name: "Repetition: Exact count",
+			line: []byte("log 2024-01-15 ok"), pattern: `\d{4}-\d{2}-\d{2}`,
+			expectedMatch: true,
+		},
+		{
+			name: "Repetition: Too few digits",
+			line: []byte("log 24-01-15 ok"), pattern: `\d{4}-\d{2}-\d{2}`,
+			expectedMatch: false,
+		},
+		{
+			name: "Repetition: Anchored upper bound",
+			line: []byte("aaaa"), pattern: `^a{1,3}$`,
+			expectedMatch: false,
+		},
+		{
+			name: "Repetition: Within bounds",
+			line: []byte("aaa"), pattern: `^a{1,3}$`,
+			expectedMatch: true,
+		},
+		{
+			name: "Repetition: Open-ended",
+			line: []byte("xaaaaaay"), pattern: `xa{3,}y`,
+			expectedMatch: true,
+		},
+		{
+			name: "Repetition: Zero times",
+			line: []byte("xy"), pattern: `^xa{0}y$`,
+			expectedMatch: true,
+		},
+	}
+
+	for _, tc := range basicTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Use the helper to process the pipeline
+			actualMatch, _, err := compileAndMatch(tc.line, tc.pattern)
+			if err != nil {
+				t.Errorf("error '%s':", err)
+			}
+
+			if actualMatch != tc.expectedMatch {
+				t.Errorf("Pattern '%s' on line '%s': expected match %v, but got %v",
+					tc.pattern, string(tc.line), tc.expectedMatch, actualMatch)
+			}
+		})
+	}
+
+	// --- Test cases specifically for validating captures ---
+	captureTestCases := []struct {
+		name             string
+		line             []byte
+		pattern          string
+		expectedMatch    bool
+		expectedCaptures []nfasimulator.Capture
+	}{
+		{
+			name:          "Captures: Single simple group",
+			line:          []byte("hello world"),
+			pattern:       "w(o)rld",
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 6, End: 11}, // "world"
+				{Start: 7, End: 8},  // "o"
+			},
+		},
+		{
+			name:          "Captures: Full string match",
+			line:          []byte("abc"),
+			pattern:       "(abc)",
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 0, End: 3}, // "abc"
+				{Start: 0, End: 3}, // "abc"
+			},
+		},
+		{
+			name:          "Captures: Nested groups",
+			line:          []byte("axbyc"),
+			pattern:       "a(x(b)y)c",
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 0, End: 5}, // "axbyc"
+				{Start: 1, End: 4}, // "xby"
+				{Start: 2, End: 3}, // "b"
+			},
+		},
+		{
+			name:             "Captures: No match, no captures",
+			line:             []byte("zzzzz"),
+			pattern:          "(a)",
+			expectedMatch:    false,
+			expectedCaptures: nil,
+		},
+		{
+			name:          "Captures: Plus quantifier",
+			line:          []byte("abbbc"),
+			pattern:       "a(b+)c",
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 0, End: 5}, // "abbbc"
+				{Start: 1, End: 4}, // "bbb"
+			},
+		},
+		{
+			name:          "Captures: Group with quantifier",
+			line:          []byte("ababab"),
+			pattern:       "(ab)+",
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 0, End: 6}, // "ababab"
+				{Start: 4, End: 6}, // "ab"
+			},
+		},
+		{
+			name:          "Captures: Group with counted repetition",
+			line:          []byte("abcabcabc"),
+			pattern:       "(abc){2}",
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 0, End: 6}, // "abcabc"
+				{Start: 3, End: 6}, // "abc"
+			},
+		},
+		{
+			name:          "Captures: Non-capturing group is not numbered",
+			line:          []byte("abc"),
+			pattern:       "(?:a)(b)c",
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 0, End: 3}, // "abc"
+				{Start: 1, End: 2}, // "b"
+			},
+		},
+		{
+			name:          "Captures: Named group",
+			line:          []byte("key=value"),
+			pattern:       "(?<key>\\w+)=(?P<value>\\w+)",
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 0, End: 9}, // "key=value"
+				{Start: 0, End: 3}, // "key"
+				{Start: 4, End: 9}, // "value"
+			},
+		},
+		{
+			name:          "Captures: Greedy star takes the longest quoted span",
+			line:          []byte(`say "a" and "b"`),
+			pattern:       `"(.*)"`,
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 4, End: 15}, // `"a" and "b"`
+				{Start: 5, End: 14}, // `a" and "b`
+			},
+		},
+		{
+			name:          "Captures: Lazy star stops at the first quote",
+			line:          []byte(`say "a" and "b"`),
+			pattern:       `"(.*?)"`,
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 4, End: 7}, // `"a"`
+				{Start: 5, End: 6}, // "a"
+			},
+		},
+		{
+			name:          "Captures: Lazy plus takes one repetition",
+			line:          []byte("aaaa"),
+			pattern:       "(a+?)",
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 0, End: 1},
+				{Start: 0, End: 1},
+			},
+		},
+		{
+			name:          "Captures: Lazy optional prefers skipping",
+			line:          []byte("ab"),
+			pattern:       "(a??)(ab)",
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 0, End: 2},
+				{Start: 0, End: 0},
+				{Start: 0, End: 2},
+			},
+		},
+		{
+			name:          "Captures: Lazy counted repetition takes the minimum",
+			line:          []byte("aaaaa"),
+			pattern:       "(a{2,4}?)",
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 0, End: 2},
+				{Start: 0, End: 2},
+			},
+		},
+		{
+			name:          "Captures: Positive lookahead keeps its captures",
+			line:          []byte("ab"),
+			pattern:       "a(?=(b))",
+			expectedMatch: true,
+			expectedCaptures: []nfasimulator.Capture{
+				{Start: 0, End: 1}, // "a"
+				{Start: 1, End: 2}, // "b"
+			},
+		},
+	}
+
+	for _, tc := range captureTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actualMatch, actualCaptures, err := compileAndMatch(tc.line, tc.pattern)
+			if err != nil {
+				t.Errorf("error '%s':", err)
+			}
+
+			if actualMatch != tc.expectedMatch {
+				t.Errorf("Pattern '%s' on line '%s': expected match %v, but got %v",
+					tc.pattern, string(tc.line), tc.expectedMatch, actualMatch)
+			}
+
+			// For captures, we need to check the actual data returned from the channel
+			if !reflect.DeepEqual(actualCaptures, tc.expectedCaptures) {
+				t.Errorf("Pattern '%s' on line '%s': incorrect captures", tc.pattern, string(tc.line))
+				t.Errorf("  got: %v", actualCaptures)
+				t.Errorf(" want: %v", tc.expectedCaptures)
+			}
+		})
+	}
+}
+
+func TestMatchSemantics(t *testing.T) {
+	testCases := []struct {
+		name            string
+		line            string
+		pattern         string
+		leftmostFirst   [][]nfasimulator.Capture
+		leftmostLongest [][]nfasimulator.Capture
+	}{
+		{
+			name:            "Alternation: first alternative or longest",
+			line:            "abc",
+			pattern:         "a|ab",
+			leftmostFirst:   [][]nfasimulator.Capture{{{Start: 0, End: 1}}},
+			leftmostLongest: [][]nfasimulator.Capture{{{Start: 0, End: 2}}},
+		},
+		{
+			name:    "Matches do not overlap",
+			line:    "ab ab",
+			pattern: "a|ab",
+			leftmostFirst: [][]nfasimulator.Capture{
+				{{Start: 0, End: 1}},
+				{{Start: 3, End: 4}},
+			},
+			leftmostLongest: [][]nfasimulator.Capture{
+				{{Start: 0, End: 2}},
+				{{Start: 3, End: 5}},
+			},
+		},
+		{
+			name:            "Lazy quantifier is still longest under POSIX",
+			line:            "aaa",
+			pattern:         "a+?",
+			leftmostFirst:   [][]nfasimulator.Capture{{{Start: 0, End: 1}}, {{Start: 1, End: 2}}, {{Start: 2, End: 3}}},
+			leftmostLongest: [][]nfasimulator.Capture{{{Start: 0, End: 3}}},
+		},
+		{
+			name:    "Same extent, earlier groups take the longest text",
+			line:    "abcd",
+			pattern: "(a|ab)(c|bcd)(d*)",
+			leftmostFirst: [][]nfasimulator.Capture{{
+				{Start: 0, End: 4}, {Start: 0, End: 1}, {Start: 1, End: 4}, {Start: 4, End: 4},
+			}},
+			leftmostLongest: [][]nfasimulator.Capture{{
+				{Start: 0, End: 4}, {Start: 0, End: 2}, {Start: 2, End: 3}, {Start: 3, End: 4},
+			}},
+		},
+		{
+			name:    "Overall length wins over a longer first group",
+			line:    "weeknights",
+			pattern: "(wee|week)(knights|night)",
+			leftmostFirst: [][]nfasimulator.Capture{{
+				{Start: 0, End: 10}, {Start: 0, End: 3}, {Start: 3, End: 10},
+			}},
+			leftmostLongest: [][]nfasimulator.Capture{{
+				{Start: 0, End: 10}, {Start: 0, End: 3}, {Start: 3, End: 10},
+			}},
+		},
+		{
+			name:    "Participating group beats a skipped one",
+			line:    "ab",
+			pattern: "(a)??(ab)?b?",
+			leftmostFirst: [][]nfasimulator.Capture{
+				{{Start: 0, End: 2}, {Start: -1, End: -1}, {Start: 0, End: 2}},
+				{{Start: 2, End: 2}, {Start: -1, End: -1}, {Start: -1, End: -1}},
+			},
+			leftmostLongest: [][]nfasimulator.Capture{
+				{{Start: 0, End: 2}, {Start: 0, End: 1}, {Start: -1, End: -1}},
+				{{Start: 2, End: 2}, {Start: -1, End: -1}, {Start: -1, End: -1}},
+			},
+		},
+		{
+			name:    "Repeated group reports its longest last iteration",
+			line:    "xabab",
+			pattern: "x(a|ab|b)*",
+			leftmostFirst: [][]nfasimulator.Capture{{
+				{Start: 0, End: 5}, {Start: 4, End: 5},
+			}},
+			leftmostLongest: [][]nfasimulator.Capture{{
+				{Start: 0, End: 5}, {Start: 3, End: 5},
+			}},
+		},
+		{
+			name:    "Nested stars on a long line",
+			line:    strings.Repeat("a", 200),
+			pattern: "(a*)*(a*)*",
+			leftmostFirst: [][]nfasimulator.Capture{
+				{{Start: 0, End: 200}, {Start: 0, End: 200}, {Start: 200, End: 200}},
+				{{Start: 200, End: 200}, {Start: 200, End: 200}, {Start: 200, End: 200}},
+			},
+			leftmostLongest: [][]nfasimulator.Capture{
+				{{Start: 0, End: 200}, {Start: 0, End: 200}, {Start: 200, End: 200}},
+				{{Start: 200, End: 200}, {Start: 200, End: 200}, {Start: 200, End: 200}},
+			},
+		},
+		{
+			name:            "Empty matches at every position",
+			line:            "ab",
+			pattern:         "x*",
+			leftmostFirst:   [][]nfasimulator.Capture{{{Start: 0, End: 0}}, {{Start: 1, End: 1}}, {{Start: 2, End: 2}}},
+			leftmostLongest: [][]nfasimulator.Capture{{{Start: 0, End: 0}}, {{Start: 1, End: 1}}, {{Start: 2, End: 2}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, semantics := range []struct {
+				name      string
+				semantics nfasimulator.Semantics
+				expected  [][]nfasimulator.Capture
+			}{
+				{"leftmost-first", nfasimulator.LeftmostFirst, tc.leftmostFirst},
+				{"leftmost-longest", nfasimulator.LeftmostLongest, tc.leftmostLongest},
+			} {
+				matches, err := compileAndFindAll([]byte(tc.line), tc.pattern, semantics.semantics)
+				if err != nil {
+					t.Fatalf("error '%s':", err)
+				}
+				if !reflect.DeepEqual(matches, semantics.expected) {
+					t.Errorf("Pattern '%s' on line '%s' (%s): incorrect matches", tc.pattern, tc.line, semantics.name)
+					t.Errorf("  got: %v", matches)
+					t.Errorf(" want: %v", semantics.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	testCases := []struct {
+		name          string
+		pattern       string
+		expectedError string
+	}{
+		{
+			name:          "Lookbehind: Unbounded star",
+			pattern:       `(?<=a*)b`,
+			expectedError: "lookbehind assertion is not bounded in length",
+		},
+		{
+			name:          "Lookbehind: Unbounded repetition",
+			pattern:       `(?<!x{2,})y`,
+			expectedError: "lookbehind assertion is not bounded in length",
+		},
+		{
+			name:          "Multi-digit backreference: Not split into a shorter one",
+			pattern:       `(a)\10`,
+			expectedError: "reference to non-existent group 10",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := compileAndMatch([]byte(""), tc.pattern)
+			if err == nil {
+				t.Fatalf("Pattern '%s': expected error '%s', but got nil", tc.pattern, tc.expectedError)
+			}
+			if err.Error() != tc.expectedError {
+				t.Errorf("Pattern '%s': expected error '%s', but got '%v'", tc.pattern, tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestMatchLineBackReferences(t *testing.T) {
+	testCases := []struct {
+		name          string
+		line          string
+		pattern       string
+		expectedMatch bool
+	}{
+		{
+			name:          "Numbered backreference: Repeated word",
+			line:          "this is is a test",
+			pattern:       `(\w+) \1`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Numbered backreference: No repetition",
+			line:          "this was a test",
+			pattern:       `(\w+) \1`,
+			expectedMatch: false,
+		},
+		{
+			name:          "Numbered backreference: Group may start inside a word",
+			line:          "this is a test",
+			pattern:       `(\w+) \1`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Numbered backreference: Inside a repeated group",
+			line:          "aabb",
+			pattern:       `^((\w)\2)+$`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Numbered backreference: Anchor after the reference",
+			line:          "abab",
+			pattern:       `^(ab)\1$`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Numbered backreference: Lookbehind after the reference",
+			line:          "xx!",
+			pattern:       `(x)\1(?<=x)!`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Numbered backreference: Group that did not participate",
+			line:          "b",
+			pattern:       `(a)?b\1`,
+			expectedMatch: false,
+		},
+		{
+			name:          "Conditional: Closing quote after an opening one",
+			line:          `"aa"`,
+			pattern:       `^(")?(\w)\2(?(1)")$`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Conditional: Missing closing quote",
+			line:          `"aa`,
+			pattern:       `^(")?(\w)\2(?(1)")$`,
+			expectedMatch: false,
+		},
+		{
+			name:          "Named backreference: Repeated word",
+			line:          "the the end",
+			pattern:       `(?<word>\w+) \k<word>`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Named backreference: Python-style group",
+			line:          "abcXabc",
+			pattern:       `(?P<tag>abc)X\k<tag>`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Atomic group: Captures inside are kept",
+			line:          "ab-ab",
+			pattern:       `(?>(\w+))-\1`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Non-capturing group: Numbering skips it",
+			line:          "ab-b",
+			pattern:       `(?:a)(b)-\1`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Multi-digit backreference: Group twelve",
+			line:          "abcdefghijkl-l",
+			pattern:       `(a)(b)(c)(d)(e)(f)(g)(h)(i)(j)(k)(l)-\12`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Braced backreference: Absolute",
+			line:          "xy-x",
+			pattern:       `(x)(y)-\g{1}`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Braced backreference: Relative",
+			line:          "xy-y",
+			pattern:       `(x)(y)-\g{-1}`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Braced backreference: Followed by a digit",
+			line:          "aa0",
+			pattern:       `(a)\g{1}0`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Case-insensitive backreference: Folds case",
+			line:          "Hello HELLO",
+			pattern:       `(?i)(\w+) \1`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Case-insensitive backreference: Unicode folding",
+			line:          "σ-Σ",
+			pattern:       `(?i)(σ)-\1`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Case-insensitive backreference: Flag reaches the rest of the pattern",
+			line:          "aA-B",
+			pattern:       `(?i)(a)\1-b`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Case-sensitive backreference: Does not fold",
+			line:          "Hello HELLO",
+			pattern:       `(\w+) \1`,
+			expectedMatch: false,
+		},
+		{
+			name:          "Empty loop body: Star of a nullable group",
+			line:          "b",
+			pattern:       `(a*)*\1`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Empty loop body: Last iteration may be empty",
+			line:          "aax",
+			pattern:       `(a*)+x\1`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Empty loop body: Non-capturing loop fails",
+			line:          "ac",
+			pattern:       `(a)(?:b*)*\1`,
+			expectedMatch: false,
+		},
+		{
+			name:          "Empty loop body: Non-capturing loop matches",
+			line:          "abba",
+			pattern:       `(a)(?:b*)*\1`,
+			expectedMatch: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actualMatch, err := matchLine([]byte(tc.line), tc.pattern, options{})
+			if err != nil {
+				t.Fatalf("error '%s':", err)
+			}
+
+			if actualMatch != tc.expectedMatch {
+				t.Errorf("Pattern '%s' on line '%s': expected match %v, but got %v",
+					tc.pattern, tc.line, tc.expectedMatch, actualMatch)
+			}
+		})
+	}
+}
+
+func TestMatchLineOptions(t *testing.T) {
+	testCases := []struct {
+		name          string
+		line          string
+		pattern       string
+		opts          options
+		expectedMatch bool
+	}{
+		{
+			name:          "Ignore case: Literal",
+			line:          "FATAL ERROR",
+			pattern:       `error`,
+			opts:          options{ignoreCase: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Ignore case: Range",
+			line:          "C",
+			pattern:       `[a-f]`,
+			opts:          options{ignoreCase: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Ignore case: Final sigma",
+			line:          "Σ",
+			pattern:       `ς`,
+			opts:          options{ignoreCase: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Ignore case: Backreference",
+			line:          "abc-ABC",
+			pattern:       `(abc)-\1`,
+			opts:          options{ignoreCase: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Ignore case: Inline flag can switch it off",
+			line:          "ERROR",
+			pattern:       `(?-i)error`,
+			opts:          options{ignoreCase: true},
+			expectedMatch: false,
+		},
+		{
+			name:          "Smart case: Lowercase pattern ignores case",
+			line:          "Error",
+			pattern:       `error`,
+			opts:          options{smartCase: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Smart case: Uppercase pattern is case-sensitive",
+			line:          "error",
+			pattern:       `Error`,
+			opts:          options{smartCase: true},
+			expectedMatch: false,
+		},
+		{
+			name:          "Smart case: Uppercase escapes do not count",
+			line:          "ERROR 1",
+			pattern:       `error\W\d`,
+			opts:          options{smartCase: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Smart case: Uppercase in a set counts",
+			line:          "error",
+			pattern:       `[E]rror`,
+			opts:          options{smartCase: true},
+			expectedMatch: false,
+		},
+		{
+			name:          "Dot-all: Wildcard spans a newline",
+			line:          "begin\nend",
+			pattern:       `begin.*end`,
+			opts:          options{dotAll: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Dot-all: Off by default",
+			line:          "begin\nend",
+			pattern:       `begin.*end`,
+			expectedMatch: false,
+		},
+		{
+			name:          "Dot-all: Inline flag can switch it off",
+			line:          "begin\nend",
+			pattern:       `(?-s)begin.*end`,
+			opts:          options{dotAll: true},
+			expectedMatch: false,
+		},
+		{
+			name:          "Dot-all: Combined with ignore case",
+			line:          "BEGIN\nEND",
+			pattern:       `begin.end`,
+			opts:          options{ignoreCase: true, dotAll: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Extended: Whitespace and comments are ignored",
+			line:          "2024-01-31",
+			pattern:       "^ \\d{4} - \\d{2} # month\n - \\d{2} $",
+			opts:          options{extended: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Extended: Escaped space still matches",
+			line:          "a b",
+			pattern:       `a\ b`,
+			opts:          options{extended: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Extended: Off by default",
+			line:          "ab",
+			pattern:       `a b`,
+			opts:          options{},
+			expectedMatch: false,
+		},
+		{
+			name:          "Extended: Inline flag can switch it off",
+			line:          "a b",
+			pattern:       `(?-x)a b`,
+			opts:          options{extended: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Inline comment: Ignored without extended mode",
+			line:          "ab",
+			pattern:       `a(?# the second letter )b`,
+			opts:          options{},
+			expectedMatch: true,
+		},
+		{
+			name:          "Basic syntax: Escaped group and interval",
+			line:          "abab",
+			pattern:       `^\(ab\)\{2\}$`,
+			opts:          options{syntax: syntaxBasic},
+			expectedMatch: true,
+		},
+		{
+			name:          "Basic syntax: Bare operators are literals",
+			line:          "f(x)+1",
+			pattern:       `f(x)+1`,
+			opts:          options{syntax: syntaxBasic},
+			expectedMatch: true,
+		},
+		{
+			name:          "Basic syntax: Alternation and backreference",
+			line:          "dog dog",
+			pattern:       `\(cat\|dog\) \1`,
+			opts:          options{syntax: syntaxBasic},
+			expectedMatch: true,
+		},
+		{
+			name:          "Basic syntax: Double hyphen is a range",
+			line:          ",",
+			pattern:       `^[+--/]$`,
+			opts:          options{syntax: syntaxBasic},
+			expectedMatch: true,
+		},
+		{
+			name:          "Basic syntax: Double ampersand is a member",
+			line:          "&",
+			pattern:       `^[a&&&]$`,
+			opts:          options{syntax: syntaxBasic},
+			expectedMatch: true,
+		},
+		{
+			name:          "Extended syntax: Escaped parenthesis is literal",
+			line:          "ab",
+			pattern:       `\(ab\)`,
+			opts:          options{syntax: syntaxExtended},
+			expectedMatch: false,
+		},
+		{
+			name:          "Fixed strings: Metacharacters are literal",
+			line:          "total: $5.00 (approx)",
+			pattern:       `$5.00 (`,
+			opts:          options{syntax: syntaxFixed},
+			expectedMatch: true,
+		},
+		{
+			name:          "Fixed strings: Dot does not match other characters",
+			line:          "a5b00",
+			pattern:       `5.00`,
+			opts:          options{syntax: syntaxFixed},
+			expectedMatch: false,
+		},
+		{
+			name:          "Fixed strings: Any of several lines",
+			line:          "connection refused",
+			pattern:       "timeout\nrefused",
+			opts:          options{syntax: syntaxFixed},
+			expectedMatch: true,
+		},
+		{
+			name:          "Fixed strings: Ignore case",
+			line:          "WARNING: low disk",
+			pattern:       "warning",
+			opts:          options{syntax: syntaxFixed, ignoreCase: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Fixed strings: Smart case with an uppercase letter",
+			line:          "WARNING: low disk",
+			pattern:       "Warning",
+			opts:          options{syntax: syntaxFixed, smartCase: true},
+			expectedMatch: false,
+		},
+		{
+			name:          "Max recursion: Nesting within the limit",
+			line:          "aaabbb",
+			pattern:       `^(a(?1)?b)$`,
+			opts:          options{maxRecursion: 2},
+			expectedMatch: true,
+		},
+		{
+			name:          "Max recursion: Nesting beyond the limit",
+			line:          "aaaabbbb",
+			pattern:       `^(a(?1)?b)$`,
+			opts:          options{maxRecursion: 2},
+			expectedMatch: false,
+		},
+		{
+			name:          "Max recursion: Zero disables calls",
+			line:          "abab",
+			pattern:       `^(ab)(?1)$`,
+			opts:          options{maxRecursion: 0},
+			expectedMatch: false,
+		},
+		{
+			name:          "POSIX: Matches the same lines",
+			line:          "abcd",
+			pattern:       `(a|ab)(c|bcd)(d*)$`,
+			opts:          options{posix: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "POSIX: Nested stars without a match",
+			line:          strings.Repeat("a", 100),
+			pattern:       `(a*)*(a*)*c`,
+			opts:          options{posix: true},
+			expectedMatch: false,
+		},
+		{
+			name:          "POSIX: Backreference to the longest capture",
+			line:          "abab",
+			pattern:       `^(a|ab)\1$`,
+			opts:          options{posix: true, maxRecursion: 1000},
+			expectedMatch: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actualMatch, err := matchLine([]byte(tc.line), tc.pattern, tc.opts)
+			if err != nil {
+				t.Fatalf("error '%s':", err)
+			}
+
+			if actualMatch != tc.expectedMatch {
+				t.Errorf("Pattern '%s' on line '%s': expected match %v, but got %v",
+					tc.pattern, tc.line, tc.expectedMatch, actualMatch)
+			}
+		})
+	}
+}
+
+func TestMatchLineRecursion(t *testing.T) {
+	testCases := []struct {
+		name          string
+		line          string
+		pattern       string
+		expectedMatch bool
+	}{
+		{
+			name:          "Numbered call: Balanced parentheses",
+			line:          "(a(b)(c(d)))",
+			pattern:       `^(\((?:[^()]|(?1))*\))$`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Numbered call: Unbalanced parentheses",
+			line:          "(a(b)(c(d))",
+			pattern:       `^(\((?:[^()]|(?1))*\))$`,
+			expectedMatch: false,
+		},
+		{
+			name:          "Numbered call: Group defined after the call",
+			line:          "abab",
+			pattern:       `^(?1)(ab)$`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Whole-pattern recursion: Nested brackets",
+			line:          "x <<a>> y",
+			pattern:       `<(?:[^<>]|(?R))*>`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Whole-pattern recursion: Anchors apply at every level",
+			line:          "aabb",
+			pattern:       `^(a(?R)?b)$`,
+			expectedMatch: false,
+		},
+		{
+			name:          "Named call: Nested lists",
+			line:          "[1,[2,[3]],4]",
+			pattern:       `^(?<list>\[(?:\d+|(?&list))(?:,(?:\d+|(?&list)))*\])$`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Named call: Python-style syntax",
+			line:          "[1,[2,]]",
+			pattern:       `^(?P<list>\[(?:\d+|(?P>list))(?:,(?:\d+|(?P>list)))*\])$`,
+			expectedMatch: false,
+		},
+		{
+			name:          "Call: Uses the group's own inline flags",
+			line:          "ab-AB",
+			pattern:       `^((?i)ab)-(?1)$`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Call: Captures inside the call are dropped",
+			line:          "ab-ba",
+			pattern:       `^(\w)b-(?1)\1$`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Call: Combined with a backreference",
+			line:          "ab-a",
+			pattern:       `^(\w)(?1)-\1$`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Call: After a loop whose body can be empty",
+			line:          "ab",
+			pattern:       `(a)(x?)*(?1)`,
+			expectedMatch: false,
+		},
+		{
+			name:          "Call: Loop whose body can be empty inside the call",
+			line:          "xaa",
+			pattern:       `x((?:b?)*a)(?1)`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Left recursion: Whole pattern",
+			line:          "aaab",
+			pattern:       `((?R)|a)*b`,
+			expectedMatch: true,
+		},
+		{
+			name:          "Left recursion: Whole pattern without a match",
+			line:          "aaaa",
+			pattern:       `((?R)|a)*b`,
+			expectedMatch: false,
+		},
+		{
+			name:          "Left recursion: Group calling itself",
+			line:          strings.Repeat("a", 32),
+			pattern:       `(a|(?1))*b`,
+			expectedMatch: false,
+		},
+	}
+
+	opts := options{maxRecursion: nfasimulator.DefaultMaxRecursionDepth}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actualMatch, err := matchLine([]byte(tc.line), tc.pattern, opts)
+			if err != nil {
+				t.Fatalf("error '%s':", err)
+			}
+
+			if actualMatch != tc.expectedMatch {
+				t.Errorf("Pattern '%s' on line '%s': expected match %v, but got %v",
+					tc.pattern, tc.line, tc.expectedMatch, actualMatch)
+			}
+		})
+	}
+}
+
+func TestDefaultSyntax(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected syntax
+		wantErr  bool
+	}{
+		{value: "", expected: syntaxExtended},
+		{value: "extended", expected: syntaxExtended},
+		{value: "basic", expected: syntaxBasic},
+		{value: "fixed", expected: syntaxFixed},
+		{value: "perl", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv(syntaxEnv, tc.value)
+			actual, err := defaultSyntax()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("defaultSyntax() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err == nil && actual != tc.expected {
+				t.Errorf("defaultSyntax() = %v, want %v", actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestProcessLinesFixedStrings(t *testing.T) {
+	input := "GET /index.html\nGET /a+b.html\nPOST /login\nGET /admin?x=1\n"
+	pattern := "a+b\n/admin?"
+
+	compiled, err := compilePatterns([]string{pattern}, options{syntax: syntaxFixed})
+	if err != nil {
+		t.Fatalf("compilePatterns() returned an unexpected error: %v", err)
+	}
+	hasMatch, matchedLines, err := processLines(strings.NewReader(input), compiled)
+	if err != nil {
+		t.Fatalf("processLines() returned an unexpected error: %v", err)
+	}
+	if !hasMatch {
+		t.Fatalf("processLines() found no match")
+	}
+
+	expected := []string{"GET /a+b.html", "GET /admin?x=1"}
+	if len(matchedLines) != len(expected) {
+		t.Fatalf("processLines() matched %q, want %q", matchedLines, expected)
+	}
+	for i, line := range matchedLines {
+		if string(line) != expected[i] {
+			t.Errorf("processLines() line %d = %q, want %q", i, line, expected[i])
+		}
+	}
+}
+
+func TestMatchMultiplePatterns(t *testing.T) {
+	testCases := []struct {
+		name          string
+		line          string
+		patterns      []string
+		opts          options
+		expectedMatch bool
+	}{
+		{
+			name:          "First pattern matches",
+			line:          "error: disk full",
+			patterns:      []string{`^error`, `^warning`},
+			expectedMatch: true,
+		},
+		{
+			name:          "Last pattern matches",
+			line:          "warning: disk almost full",
+			patterns:      []string{`^error`, `^warning`},
+			expectedMatch: true,
+		},
+		{
+			name:          "No pattern matches",
+			line:          "info: all good",
+			patterns:      []string{`^error`, `^warning`},
+			expectedMatch: false,
+		},
+		{
+			name:          "No patterns at all",
+			line:          "anything",
+			patterns:      nil,
+			expectedMatch: false,
+		},
+		{
+			name:          "Empty pattern matches every line",
+			line:          "anything",
+			patterns:      []string{`^x`, ``},
+			expectedMatch: true,
+		},
+		{
+			name:          "Pattern starting with a dash",
+			line:          "use --verbose here",
+			patterns:      []string{`--verbose`},
+			expectedMatch: true,
+		},
+		{
+			name:          "Groups are numbered per pattern",
+			line:          "b-b",
+			patterns:      []string{`(a)-\1`, `(b)-\1`},
+			expectedMatch: true,
+		},
+		{
+			name:          "Backreference does not see another pattern's group",
+			line:          "a-b",
+			patterns:      []string{`(a)x`, `(\w)-\1`},
+			expectedMatch: false,
+		},
+		{
+			name:          "Recursion stays within its pattern",
+			line:          "(())",
+			patterns:      []string{`^x$`, `^(\((?1)*\))$`},
+			opts:          options{maxRecursion: nfasimulator.DefaultMaxRecursionDepth},
+			expectedMatch: true,
+		},
+		{
+			name:          "Options apply to every pattern",
+			line:          "WARNING",
+			patterns:      []string{`error`, `warning`},
+			opts:          options{ignoreCase: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Fixed strings from several patterns",
+			line:          "a+b",
+			patterns:      []string{`x.y`, `a+b`},
+			opts:          options{syntax: syntaxFixed},
+			expectedMatch: true,
+		},
+		{
+			name:          "Smart case: Uppercase in any pattern makes every pattern case-sensitive",
+			line:          "FOO",
+			patterns:      []string{`foo`, `Bar`},
+			opts:          options{syntax: syntaxExtended, smartCase: true},
+			expectedMatch: false,
+		},
+		{
+			name:          "Smart case: Each pattern still matches its own case",
+			line:          "Bar",
+			patterns:      []string{`foo`, `Bar`},
+			opts:          options{syntax: syntaxExtended, smartCase: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Smart case: Lowercase patterns ignore case",
+			line:          "BAR",
+			patterns:      []string{`foo`, `bar`},
+			opts:          options{syntax: syntaxExtended, smartCase: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Smart case with fixed strings: Uppercase in any pattern makes every pattern case-sensitive",
+			line:          "FOO",
+			patterns:      []string{`foo`, `Bar`},
+			opts:          options{syntax: syntaxFixed, smartCase: true},
+			expectedMatch: false,
+		},
+		{
+			name:          "Smart case with fixed strings: Each pattern still matches its own case",
+			line:          "Bar",
+			patterns:      []string{`foo`, `Bar`},
+			opts:          options{syntax: syntaxFixed, smartCase: true},
+			expectedMatch: true,
+		},
+		{
+			name:          "Smart case with fixed strings: Lowercase patterns ignore case",
+			line:          "BAR",
+			patterns:      []string{`foo`, `bar`},
+			opts:          options{syntax: syntaxFixed, smartCase: true},
+			expectedMatch: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			compiled, err := compilePatterns(tc.patterns, tc.opts)
+			if err != nil {
+				t.Fatalf("error '%s':", err)
+			}
+			actualMatch, err := compiled.match([]byte(tc.line))
+			if err != nil {
+				t.Fatalf("error '%s':", err)
+			}
+
+			if actualMatch != tc.expectedMatch {
+				t.Errorf("Patterns %q on line '%s': expected match %v, but got %v",
+					tc.patterns, tc.line, tc.expectedMatch, actualMatch)
+			}
+		})
+	}
+}
+
+func TestMatchLeavesNoGoroutines(t *testing.T) {
+	for _, pattern := range []string{`a`, `(a)\1?`} {
+		compiled, err := compilePatterns([]string{pattern}, options{maxRecursion: nfasimulator.DefaultMaxRecursionDepth})
+		if err != nil {
+			t.Fatalf("error '%s':", err)
+		}
+
+		before := runtime.NumGoroutine()
+		for range 100 {
+			if _, err := compiled.match([]byte("a a a")); err != nil {
+				t.Fatalf("error '%s':", err)
+			}
+		}
+		if after := runtime.NumGoroutine(); after > before {
+			t.Errorf("Pattern '%s': %d goroutines left running after matching", pattern, after-before)
+		}
+	}
+}
+
+func TestReadPatternFile(t *testing.T) {
+	filePath := createTestFile(t, "^error\n\n(?i)warning\n")
+
+	patterns, err := readPatternFile(filePath)
+	if err != nil {
+		t.Fatalf("readPatternFile() returned an unexpected error: %v", err)
+	}
+
+	expected := []string{"^error", "", "(?i)warning"}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("readPatternFile() = %q, want %q", patterns, expected)
+	}
+
+	if _, err := readPatternFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Errorf("readPatternFile() of a missing file returned no error")
 	}
 }
 
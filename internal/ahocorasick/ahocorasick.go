@@ -0,0 +1,125 @@
+// Package ahocorasick defines a matcher that searches for many literal
+// strings at once
+package ahocorasick
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// node is a state of the automaton: the needle prefix spelled by the path
+// from the root.
+type node struct {
+	next map[rune]int
+	// fail is the node for the longest proper suffix of this prefix that
+	// is also a needle prefix.
+	fail int
+	// accepting is set when a needle ends here, or at any node reached by
+	// following fail links, so that a single check per rune is enough.
+	accepting bool
+}
+
+// Automaton reports whether any of a set of needles occurs in a line. It
+// reads the line once, one rune at a time, however many needles there are.
+type Automaton struct {
+	nodes           []node
+	caseInsensitive bool
+}
+
+// New builds the automaton for needles. With caseInsensitive set, runes are
+// compared under Unicode simple case folding. An empty needle matches every
+// line.
+func New(needles []string, caseInsensitive bool) *Automaton {
+	a := &Automaton{
+		nodes:           []node{{next: map[rune]int{}}},
+		caseInsensitive: caseInsensitive,
+	}
+	for _, needle := range needles {
+		a.insert(needle)
+	}
+	a.linkFailures()
+	return a
+}
+
+func (a *Automaton) insert(needle string) {
+	current := 0
+	for _, r := range needle {
+		r = a.normalize(r)
+		next, ok := a.nodes[current].next[r]
+		if !ok {
+			next = len(a.nodes)
+			a.nodes = append(a.nodes, node{next: map[rune]int{}})
+			a.nodes[current].next[r] = next
+		}
+		current = next
+	}
+	a.nodes[current].accepting = true
+}
+
+// linkFailures sets the fail link of every node, visiting them in order of
+// depth so that the links of shorter prefixes are known first.
+func (a *Automaton) linkFailures() {
+	queue := []int{}
+	for _, child := range a.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for r, child := range a.nodes[current].next {
+			fail := a.nodes[current].fail
+			for fail != 0 && !a.hasEdge(fail, r) {
+				fail = a.nodes[fail].fail
+			}
+			if target, ok := a.nodes[fail].next[r]; ok {
+				a.nodes[child].fail = target
+			}
+			if a.nodes[a.nodes[child].fail].accepting {
+				a.nodes[child].accepting = true
+			}
+			queue = append(queue, child)
+		}
+	}
+}
+
+func (a *Automaton) hasEdge(state int, r rune) bool {
+	_, ok := a.nodes[state].next[r]
+	return ok
+}
+
+// Match reports whether any needle occurs in line.
+func (a *Automaton) Match(line []byte) bool {
+	current := 0
+	if a.nodes[current].accepting {
+		return true
+	}
+	for index := 0; index < len(line); {
+		r, size := utf8.DecodeRune(line[index:])
+		index += size
+		r = a.normalize(r)
+
+		for current != 0 && !a.hasEdge(current, r) {
+			current = a.nodes[current].fail
+		}
+		if next, ok := a.nodes[current].next[r]; ok {
+			current = next
+		}
+		if a.nodes[current].accepting {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize maps r to the smallest rune of its case folding orbit when the
+// automaton ignores case, so that every case variant takes the same edge.
+func (a *Automaton) normalize(r rune) rune {
+	if !a.caseInsensitive {
+		return r
+	}
+	smallest := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		smallest = min(smallest, f)
+	}
+	return smallest
+}
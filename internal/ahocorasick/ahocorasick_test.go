@@ -0,0 +1,121 @@
+package ahocorasick
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name            string
+		needles         []string
+		line            string
+		caseInsensitive bool
+		wantMatch       bool
+	}{
+		{
+			name:      "single needle",
+			needles:   []string{"apple"},
+			line:      "an apple a day",
+			wantMatch: true,
+		},
+		{
+			name:      "single needle missing",
+			needles:   []string{"apple"},
+			line:      "an appl a day",
+			wantMatch: false,
+		},
+		{
+			name:      "metacharacters are literal",
+			needles:   []string{"a.c*"},
+			line:      "abc a.c*",
+			wantMatch: true,
+		},
+		{
+			name:      "metacharacters do not match other text",
+			needles:   []string{"a.c*"},
+			line:      "abcc",
+			wantMatch: false,
+		},
+		{
+			name:      "any of several needles",
+			needles:   []string{"he", "she", "his", "hers"},
+			line:      "ushers",
+			wantMatch: true,
+		},
+		{
+			name:      "needle found through a failure link",
+			needles:   []string{"abcd", "bc"},
+			line:      "xabcx",
+			wantMatch: true,
+		},
+		{
+			name:      "needle that is a suffix of a partial match",
+			needles:   []string{"aab"},
+			line:      "aaab",
+			wantMatch: true,
+		},
+		{
+			name:      "empty needle matches every line",
+			needles:   []string{"zzz", ""},
+			line:      "abc",
+			wantMatch: true,
+		},
+		{
+			name:      "no needles",
+			needles:   nil,
+			line:      "abc",
+			wantMatch: false,
+		},
+		{
+			name:      "non-ASCII needle",
+			needles:   []string{"über"},
+			line:      "Ein übergroßes Haus",
+			wantMatch: true,
+		},
+		{
+			name:      "case-sensitive by default",
+			needles:   []string{"Error"},
+			line:      "ERROR: disk full",
+			wantMatch: false,
+		},
+		{
+			name:            "case-insensitive",
+			needles:         []string{"Error"},
+			line:            "ERROR: disk full",
+			caseInsensitive: true,
+			wantMatch:       true,
+		},
+		{
+			name:            "case-insensitive with case folding orbits",
+			needles:         []string{"straße"},
+			line:            "STRASSE or STRAẞE",
+			caseInsensitive: true,
+			wantMatch:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(tt.needles, tt.caseInsensitive)
+			if match := a.Match([]byte(tt.line)); match != tt.wantMatch {
+				t.Errorf("Match(%q) with needles %q = %v, want %v", tt.line, tt.needles, match, tt.wantMatch)
+			}
+		})
+	}
+}
+
+func TestMatch_ManyNeedles(t *testing.T) {
+	needles := make([]string, 0, 50000)
+	for i := range 50000 {
+		needles = append(needles, fmt.Sprintf("token-%05d;", i))
+	}
+	a := New(needles, false)
+
+	if !a.Match([]byte("request denied for token-49999; retry")) {
+		t.Errorf("Match() did not find the last needle")
+	}
+	if a.Match([]byte("request denied for token-50000; retry")) {
+		t.Errorf("Match() found a needle that is not in the list")
+	}
+}
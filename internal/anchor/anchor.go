@@ -0,0 +1,22 @@
+// Package anchor defines the kinds of positional anchors
+package anchor
+
+type Anchor int
+
+const (
+	// TextStart (\A, and ^ outside multiline mode) holds at the start of
+	// the subject.
+	TextStart Anchor = iota
+	// TextEnd (\z, and $ outside multiline mode) holds at the end of the
+	// subject.
+	TextEnd
+	// TextEndBeforeNewline (\Z) holds at the end of the subject and before a
+	// newline that ends it.
+	TextEndBeforeNewline
+	// LineStart (^ in multiline mode) holds at the start of the subject and
+	// after every newline.
+	LineStart
+	// LineEnd ($ in multiline mode) holds at the end of the subject and
+	// before every newline.
+	LineEnd
+)
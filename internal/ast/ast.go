@@ -1,7 +1,11 @@
 // Package ast defines the structure of an AST
 package ast
 
-import predefinedclass "github.com/mmarchesotti/build-your-own-grep/internal/predefinedclass"
+import (
+	"github.com/mmarchesotti/build-your-own-grep/internal/anchor"
+	"github.com/mmarchesotti/build-your-own-grep/internal/boundary"
+	predefinedclass "github.com/mmarchesotti/build-your-own-grep/internal/predefinedclass"
+)
 
 type ASTNode interface {
 	isASTNode()
@@ -17,6 +21,47 @@ type CaptureGroupNode struct {
 	GroupIndex int
 }
 
+// BackReferenceNode matches the text most recently captured by the group
+// with index GroupIndex, ignoring case differences when CaseInsensitive is
+// set.
+type BackReferenceNode struct {
+	baseASTNode
+	GroupIndex      int
+	CaseInsensitive bool
+}
+
+// SubroutineCallNode matches the subpattern of the group with index
+// GroupIndex, or the whole pattern when it is 0.
+type SubroutineCallNode struct {
+	baseASTNode
+	GroupIndex int
+}
+
+// AtomicGroupNode matches its child once, keeping the first way it finds and
+// never backtracking into it to try another. Possessive quantifiers are
+// atomic groups around the greedy quantifier.
+type AtomicGroupNode struct {
+	baseASTNode
+	Child ASTNode
+}
+
+// LookaheadNode asserts that its child matches (or, when Negated, does not
+// match) starting at the current position, without consuming any input.
+type LookaheadNode struct {
+	baseASTNode
+	Child   ASTNode
+	Negated bool
+}
+
+// LookbehindNode asserts that its child matches (or, when Negated, does not
+// match) ending at the current position, without consuming any input. The
+// child must have a bounded length.
+type LookbehindNode struct {
+	baseASTNode
+	Child   ASTNode
+	Negated bool
+}
+
 type AlternationNode struct {
 	baseASTNode
 	Left  ASTNode
@@ -29,36 +74,69 @@ type ConcatenationNode struct {
 	Right ASTNode
 }
 
+// The quantifier nodes are greedy by default and prefer as many repetitions
+// as possible. When Lazy is set they prefer as few as possible instead.
+
 type KleeneClosureNode struct {
 	baseASTNode
 	Child ASTNode
+	Lazy  bool
 }
 
 type PositiveClosureNode struct {
 	baseASTNode
 	Child ASTNode
+	Lazy  bool
 }
 
 type OptionalNode struct {
 	baseASTNode
 	Child ASTNode
+	Lazy  bool
+}
+
+// RepetitionNode repeats its child between Min and Max times. Max is -1
+// when the repetition has no upper bound.
+type RepetitionNode struct {
+	baseASTNode
+	Child ASTNode
+	Min   int
+	Max   int
+	Lazy  bool
 }
 
 type LiteralNode struct {
 	baseASTNode
-	Literal rune
+	Literal         rune
+	CaseInsensitive bool
 }
 
+// CharacterSetNode matches a rune that is one of the members, in every set
+// in Intersect and in none of the sets in Subtract, or the opposite when
+// IsPositive is false. CaseInsensitive applies to the whole expression, so
+// it is only set on the outermost node.
 type CharacterSetNode struct {
 	baseASTNode
-	IsPositive       bool
-	Literals         []rune
-	Ranges           [][2]rune
-	CharacterClasses []predefinedclass.PredefinedClass
+	IsPositive        bool
+	Literals          []rune
+	Ranges            [][2]rune
+	CharacterClasses  []predefinedclass.PredefinedClass
+	UnicodeProperties []predefinedclass.UnicodeProperty
+	Intersect         []*CharacterSetNode
+	Subtract          []*CharacterSetNode
+	CaseInsensitive   bool
 }
 
+type UnicodeClassNode struct {
+	baseASTNode
+	Name    string
+	Negated bool
+}
+
+// WildcardNode matches any rune but a newline, unless DotAll is set.
 type WildcardNode struct {
 	baseASTNode
+	DotAll bool
 }
 
 type DigitNode struct {
@@ -69,10 +147,44 @@ type AlphaNumericNode struct {
 	baseASTNode
 }
 
-type StartAnchorNode struct {
+type WhitespaceNode struct {
+	baseASTNode
+}
+
+type NonDigitNode struct {
+	baseASTNode
+}
+
+type NonAlphaNumericNode struct {
+	baseASTNode
+}
+
+type NonWhitespaceNode struct {
+	baseASTNode
+}
+
+type AnchorNode struct {
 	baseASTNode
+	Kind anchor.Anchor
 }
 
-type EndAnchorNode struct {
+// EmptyNode matches the empty string. It stands for an empty pattern, or
+// for an inline flag modifier that is not followed by anything in its group.
+type EmptyNode struct {
 	baseASTNode
 }
+
+type WordBoundaryNode struct {
+	baseASTNode
+	Kind boundary.Boundary
+}
+
+// ConditionalNode matches Yes if the group GroupIndex has participated in
+// the match so far, and No otherwise. No is an EmptyNode when the
+// conditional has a single branch.
+type ConditionalNode struct {
+	baseASTNode
+	GroupIndex int
+	Yes        ASTNode
+	No         ASTNode
+}
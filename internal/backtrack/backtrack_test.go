@@ -3,6 +3,7 @@ package backtrack
 import (
 	"testing"
 
+	"github.com/mmarchesotti/build-your-own-grep/internal/nfasimulator"
 	"github.com/mmarchesotti/build-your-own-grep/internal/token"
 )
 
@@ -106,11 +107,92 @@ func TestRun_Backreferences(t *testing.T) {
 			wantMatch: true,
 			wantErr:   false,
 		},
+		{
+			name: "Named backreference (?<w>ab)\\k<w>",
+			line: "xxabab",
+			// Represents: (?<w>ab)\k<w>
+			tokens: []token.Token{
+				&token.GroupingOpener{Name: "w"},
+				&token.Literal{Literal: 'a'},
+				&token.Literal{Literal: 'b'},
+				&token.GroupingCloser{},
+				&token.BackReference{Name: "w"},
+			},
+			wantMatch: true,
+			wantErr:   false,
+		},
+		{
+			name: "Non-capturing group shifts numbering (?:a)(b)\\1",
+			line: "abb",
+			// Represents: (?:a)(b)\1, where \1 refers to (b)
+			tokens: []token.Token{
+				&token.GroupingOpener{Kind: token.GroupNonCapturing},
+				&token.Literal{Literal: 'a'},
+				&token.GroupingCloser{},
+				&token.GroupingOpener{},
+				&token.Literal{Literal: 'b'},
+				&token.GroupingCloser{},
+				&token.BackReference{CaptureIndex: 1},
+			},
+			wantMatch: true,
+			wantErr:   false,
+		},
+		{
+			name: "Conditional backreference (a)?b(?(1)\\1|c)",
+			line: "aba",
+			// Represents: (a)?b(?(1)\1|c)
+			tokens: []token.Token{
+				&token.GroupingOpener{},
+				&token.Literal{Literal: 'a'},
+				&token.GroupingCloser{},
+				&token.OptionalQuantifier{},
+				&token.Literal{Literal: 'b'},
+				&token.GroupingOpener{Kind: token.GroupConditional, ConditionIndex: 1},
+				&token.BackReference{CaptureIndex: 1},
+				&token.Alternation{},
+				&token.Literal{Literal: 'c'},
+				&token.GroupingCloser{},
+			},
+			wantMatch: true,
+			wantErr:   false,
+		},
+		{
+			name: "Conditional backreference without the group (a)?b(?(1)\\1|c)",
+			line: "ba",
+			// Represents: (a)?b(?(1)\1|c)
+			tokens: []token.Token{
+				&token.GroupingOpener{},
+				&token.Literal{Literal: 'a'},
+				&token.GroupingCloser{},
+				&token.OptionalQuantifier{},
+				&token.Literal{Literal: 'b'},
+				&token.GroupingOpener{Kind: token.GroupConditional, ConditionIndex: 1},
+				&token.BackReference{CaptureIndex: 1},
+				&token.Alternation{},
+				&token.Literal{Literal: 'c'},
+				&token.GroupingCloser{},
+			},
+			wantMatch: false,
+			wantErr:   false,
+		},
+		{
+			name: "Unknown group name",
+			line: "aa",
+			// Represents: (a)\k<missing>
+			tokens: []token.Token{
+				&token.GroupingOpener{},
+				&token.Literal{Literal: 'a'},
+				&token.GroupingCloser{},
+				&token.BackReference{Name: "missing"},
+			},
+			wantMatch: false,
+			wantErr:   true,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			match, err := Run([]byte(tt.line), tt.tokens)
+			match, err := Run([]byte(tt.line), tt.tokens, nfasimulator.DefaultMaxRecursionDepth)
 
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Run() error = %v, wantErr %v", err, tt.wantErr)
@@ -0,0 +1,15 @@
+// Package boundary defines the kinds of word boundary assertions
+package boundary
+
+type Boundary int
+
+const (
+	// WordBoundary (\b) holds between a word and a non-word character.
+	WordBoundary Boundary = iota
+	// NonWordBoundary (\B) holds wherever WordBoundary does not.
+	NonWordBoundary
+	// WordStart (\<) holds before the first character of a word.
+	WordStart
+	// WordEnd (\>) holds after the last character of a word.
+	WordEnd
+)
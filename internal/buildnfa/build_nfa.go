@@ -21,6 +21,245 @@ func newMatcherFragment(m matcher.Matcher) nfa.Fragment {
 	}
 }
 
+func newClassMatcher(class predefinedclass.PredefinedClass) (matcher.PredefinedClassMatcher, error) {
+	switch class {
+	case predefinedclass.ClassDigit:
+		return &matcher.DigitMatcher{}, nil
+	case predefinedclass.ClassAlphanumeric:
+		return &matcher.AlphaNumericMatcher{}, nil
+	case predefinedclass.ClassWhitespace:
+		return &matcher.WhitespaceMatcher{}, nil
+	case predefinedclass.ClassNonDigit:
+		return &matcher.NegatedClassMatcher{Class: &matcher.DigitMatcher{}}, nil
+	case predefinedclass.ClassNonAlphanumeric:
+		return &matcher.NegatedClassMatcher{Class: &matcher.AlphaNumericMatcher{}}, nil
+	case predefinedclass.ClassNonWhitespace:
+		return &matcher.NegatedClassMatcher{Class: &matcher.WhitespaceMatcher{}}, nil
+	case predefinedclass.ClassAlpha:
+		return &matcher.AlphaMatcher{}, nil
+	case predefinedclass.ClassAlnum:
+		return &matcher.AlnumMatcher{}, nil
+	case predefinedclass.ClassBlank:
+		return &matcher.BlankMatcher{}, nil
+	case predefinedclass.ClassCntrl:
+		return &matcher.CntrlMatcher{}, nil
+	case predefinedclass.ClassGraph:
+		return &matcher.GraphMatcher{}, nil
+	case predefinedclass.ClassLower:
+		return &matcher.LowerMatcher{}, nil
+	case predefinedclass.ClassPrint:
+		return &matcher.PrintMatcher{}, nil
+	case predefinedclass.ClassPunct:
+		return &matcher.PunctMatcher{}, nil
+	case predefinedclass.ClassUpper:
+		return &matcher.UpperMatcher{}, nil
+	case predefinedclass.ClassXDigit:
+		return &matcher.XDigitMatcher{}, nil
+	default:
+		return nil, fmt.Errorf("unexpected character class %d", class)
+	}
+}
+
+func newUnicodeClassMatcher(name string, negated bool) (matcher.PredefinedClassMatcher, error) {
+	table, ok := predefinedclass.LookupUnicodeProperty(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown Unicode property %q", name)
+	}
+	var m matcher.PredefinedClassMatcher = &matcher.UnicodeClassMatcher{Table: table}
+	if negated {
+		m = &matcher.NegatedClassMatcher{Class: m}
+	}
+	return m, nil
+}
+
+// newCharacterSetMatcher builds the matcher for a bracket expression and the
+// operands of its && and -- operators.
+func newCharacterSetMatcher(node *ast.CharacterSetNode) (*matcher.CharacterSetMatcher, error) {
+	for _, rng := range node.Ranges {
+		if rng[0] > rng[1] {
+			return nil, fmt.Errorf("invalid character range %c-%c", rng[0], rng[1])
+		}
+	}
+	var characterClassesMatchers []matcher.PredefinedClassMatcher
+	for _, characterClass := range node.CharacterClasses {
+		m, err := newClassMatcher(characterClass)
+		if err != nil {
+			return nil, err
+		}
+		characterClassesMatchers = append(characterClassesMatchers, m)
+	}
+	for _, property := range node.UnicodeProperties {
+		m, err := newUnicodeClassMatcher(property.Name, property.Negated)
+		if err != nil {
+			return nil, err
+		}
+		characterClassesMatchers = append(characterClassesMatchers, m)
+	}
+	characterSetMatcher := &matcher.CharacterSetMatcher{
+		IsPositive:               node.IsPositive,
+		Literals:                 node.Literals,
+		Ranges:                   node.Ranges,
+		CharacterClassesMatchers: characterClassesMatchers,
+		CaseInsensitive:          node.CaseInsensitive,
+	}
+	for _, operand := range node.Intersect {
+		m, err := newCharacterSetMatcher(operand)
+		if err != nil {
+			return nil, err
+		}
+		characterSetMatcher.Intersect = append(characterSetMatcher.Intersect, m)
+	}
+	for _, operand := range node.Subtract {
+		m, err := newCharacterSetMatcher(operand)
+		if err != nil {
+			return nil, err
+		}
+		characterSetMatcher.Subtract = append(characterSetMatcher.Subtract, m)
+	}
+	return characterSetMatcher, nil
+}
+
+// newQuantifierSplit returns the split state of a quantifier together with
+// a pointer to its exit branch. The simulator explores Branch1 first, so a
+// greedy quantifier puts the way into its fragment there and a lazy one puts
+// the exit there instead.
+func newQuantifierSplit(enter nfa.State, lazy bool) (*nfa.SplitState, *nfa.State) {
+	split := &nfa.SplitState{}
+	if lazy {
+		split.Branch2 = enter
+		return split, &split.Branch1
+	}
+	split.Branch1 = enter
+	return split, &split.Branch2
+}
+
+// newEmptyFragment returns a fragment that matches the empty string. Both
+// branches of its split lead to whatever state follows the fragment.
+func newEmptyFragment() nfa.Fragment {
+	split := nfa.SplitState{}
+	return nfa.Fragment{
+		Start: &split,
+		Out:   []*nfa.State{&split.Branch1, &split.Branch2},
+	}
+}
+
+// expandRepetition rewrites a counted repetition into concatenations of
+// mandatory copies followed by either a closure or nested optionals, so
+// x{2,4} becomes xx(x(x)?)? and x{2,} becomes xxx*. It returns nil when
+// the repetition can only match the empty string.
+func expandRepetition(node *ast.RepetitionNode) ast.ASTNode {
+	var tail ast.ASTNode
+	if node.Max == -1 {
+		tail = &ast.KleeneClosureNode{Child: node.Child, Lazy: node.Lazy}
+	} else {
+		for range node.Max - node.Min {
+			if tail == nil {
+				tail = &ast.OptionalNode{Child: node.Child, Lazy: node.Lazy}
+			} else {
+				tail = &ast.OptionalNode{
+					Child: &ast.ConcatenationNode{Left: node.Child, Right: tail},
+					Lazy:  node.Lazy,
+				}
+			}
+		}
+	}
+
+	var expanded ast.ASTNode
+	for range node.Min {
+		if expanded == nil {
+			expanded = node.Child
+		} else {
+			expanded = &ast.ConcatenationNode{Left: expanded, Right: node.Child}
+		}
+	}
+
+	switch {
+	case expanded == nil:
+		return tail
+	case tail == nil:
+		return expanded
+	default:
+		return &ast.ConcatenationNode{Left: expanded, Right: tail}
+	}
+}
+
+// processBody builds the fragment for the body of an atomic group or a
+// lookaround and closes it with its own AcceptingState.
+func processBody(n ast.ASTNode) (nfa.State, error) {
+	subfragment, err := processNode(n)
+	if err != nil {
+		return nil, err
+	}
+	nfa.SetStates(subfragment.Out, &nfa.AcceptingState{})
+	return subfragment.Start, nil
+}
+
+// width returns the minimum and maximum number of runes a node can match.
+// The maximum is -1 when it is unbounded, or when the node's length cannot
+// be known in advance, as with backreferences.
+func width(n ast.ASTNode) (int, int) {
+	switch node := n.(type) {
+	case *ast.LiteralNode, *ast.CharacterSetNode, *ast.WildcardNode,
+		*ast.DigitNode, *ast.AlphaNumericNode, *ast.WhitespaceNode,
+		*ast.NonDigitNode, *ast.NonAlphaNumericNode, *ast.NonWhitespaceNode,
+		*ast.UnicodeClassNode:
+		return 1, 1
+	case *ast.AnchorNode, *ast.WordBoundaryNode, *ast.EmptyNode,
+		*ast.LookaheadNode, *ast.LookbehindNode:
+		return 0, 0
+	case *ast.CaptureGroupNode:
+		return width(node.Child)
+	case *ast.AtomicGroupNode:
+		return width(node.Child)
+	case *ast.ConcatenationNode:
+		leftMin, leftMax := width(node.Left)
+		rightMin, rightMax := width(node.Right)
+		if leftMax == -1 || rightMax == -1 {
+			return leftMin + rightMin, -1
+		}
+		return leftMin + rightMin, leftMax + rightMax
+	case *ast.AlternationNode:
+		leftMin, leftMax := width(node.Left)
+		rightMin, rightMax := width(node.Right)
+		if leftMax == -1 || rightMax == -1 {
+			return min(leftMin, rightMin), -1
+		}
+		return min(leftMin, rightMin), max(leftMax, rightMax)
+	case *ast.ConditionalNode:
+		yesMin, yesMax := width(node.Yes)
+		noMin, noMax := width(node.No)
+		if yesMax == -1 || noMax == -1 {
+			return min(yesMin, noMin), -1
+		}
+		return min(yesMin, noMin), max(yesMax, noMax)
+	case *ast.OptionalNode:
+		_, childMax := width(node.Child)
+		return 0, childMax
+	case *ast.KleeneClosureNode:
+		return repeatedWidth(node.Child, 0, -1)
+	case *ast.PositiveClosureNode:
+		return repeatedWidth(node.Child, 1, -1)
+	case *ast.RepetitionNode:
+		return repeatedWidth(node.Child, node.Min, node.Max)
+	default:
+		return 0, -1
+	}
+}
+
+// repeatedWidth returns the width of child repeated between minCount and
+// maxCount times, where a maxCount of -1 means without an upper bound.
+func repeatedWidth(child ast.ASTNode, minCount int, maxCount int) (int, int) {
+	childMin, childMax := width(child)
+	switch {
+	case childMax == 0:
+		return 0, 0
+	case childMax == -1 || maxCount == -1:
+		return childMin * minCount, -1
+	default:
+		return childMin * minCount, childMax * maxCount
+	}
+}
+
 func processNode(n ast.ASTNode) (nfa.Fragment, error) {
 	switch node := n.(type) {
 	case *ast.CaptureGroupNode:
@@ -44,6 +283,53 @@ func processNode(n ast.ASTNode) (nfa.Fragment, error) {
 			Start: startState,
 			Out:   []*nfa.State{&endState.Out},
 		}, nil
+	case *ast.AtomicGroupNode:
+		body, err := processBody(node.Child)
+		if err != nil {
+			return nfa.Fragment{}, err
+		}
+		s := &nfa.AtomicGroupState{
+			Body: body,
+			Out:  nil,
+		}
+		return nfa.Fragment{
+			Start: s,
+			Out:   []*nfa.State{&s.Out},
+		}, nil
+	case *ast.LookaheadNode:
+		body, err := processBody(node.Child)
+		if err != nil {
+			return nfa.Fragment{}, err
+		}
+		s := &nfa.LookaheadState{
+			Body:    body,
+			Out:     nil,
+			Negated: node.Negated,
+		}
+		return nfa.Fragment{
+			Start: s,
+			Out:   []*nfa.State{&s.Out},
+		}, nil
+	case *ast.LookbehindNode:
+		minWidth, maxWidth := width(node.Child)
+		if maxWidth == -1 {
+			return nfa.Fragment{}, fmt.Errorf("lookbehind assertion is not bounded in length")
+		}
+		body, err := processBody(node.Child)
+		if err != nil {
+			return nfa.Fragment{}, err
+		}
+		s := &nfa.LookbehindState{
+			Body:     body,
+			Out:      nil,
+			Negated:  node.Negated,
+			MinWidth: minWidth,
+			MaxWidth: maxWidth,
+		}
+		return nfa.Fragment{
+			Start: s,
+			Out:   []*nfa.State{&s.Out},
+		}, nil
 	case *ast.AlternationNode:
 		subfragment1, err1 := processNode(node.Left)
 		if err1 != nil {
@@ -61,6 +347,24 @@ func processNode(n ast.ASTNode) (nfa.Fragment, error) {
 			Out: append(subfragment1.Out, subfragment2.Out...),
 		}
 		return frag, nil
+	case *ast.ConditionalNode:
+		yesFragment, err := processNode(node.Yes)
+		if err != nil {
+			return nfa.Fragment{}, err
+		}
+		noFragment, err := processNode(node.No)
+		if err != nil {
+			return nfa.Fragment{}, err
+		}
+		frag := nfa.Fragment{
+			Start: &nfa.ConditionalState{
+				GroupIndex: node.GroupIndex,
+				Yes:        yesFragment.Start,
+				No:         noFragment.Start,
+			},
+			Out: append(yesFragment.Out, noFragment.Out...),
+		}
+		return frag, nil
 	case *ast.ConcatenationNode:
 		subfragment1, err1 := processNode(node.Left)
 		if err1 != nil {
@@ -81,14 +385,11 @@ func processNode(n ast.ASTNode) (nfa.Fragment, error) {
 		if err != nil {
 			return nfa.Fragment{}, err
 		}
-		split := nfa.SplitState{
-			Branch1: subfragment.Start,
-			Branch2: nil,
-		}
-		nfa.SetStates(subfragment.Out, &split)
+		split, exit := newQuantifierSplit(subfragment.Start, node.Lazy)
+		nfa.SetStates(subfragment.Out, split)
 		frag := nfa.Fragment{
-			Start: &split,
-			Out:   []*nfa.State{&split.Branch2},
+			Start: split,
+			Out:   []*nfa.State{exit},
 		}
 		return frag, nil
 	case *ast.PositiveClosureNode:
@@ -96,14 +397,11 @@ func processNode(n ast.ASTNode) (nfa.Fragment, error) {
 		if err != nil {
 			return nfa.Fragment{}, err
 		}
-		split := nfa.SplitState{
-			Branch1: subfragment.Start,
-			Branch2: nil,
-		}
-		nfa.SetStates(subfragment.Out, &split)
+		split, exit := newQuantifierSplit(subfragment.Start, node.Lazy)
+		nfa.SetStates(subfragment.Out, split)
 		frag := nfa.Fragment{
 			Start: subfragment.Start,
-			Out:   []*nfa.State{&split.Branch2},
+			Out:   []*nfa.State{exit},
 		}
 		return frag, nil
 	case *ast.OptionalNode:
@@ -111,54 +409,90 @@ func processNode(n ast.ASTNode) (nfa.Fragment, error) {
 		if err != nil {
 			return nfa.Fragment{}, err
 		}
-		split := nfa.SplitState{
-			Branch1: subfragment.Start,
-			Branch2: nil,
-		}
+		split, exit := newQuantifierSplit(subfragment.Start, node.Lazy)
 		frag := nfa.Fragment{
-			Start: &split,
-			Out:   append(subfragment.Out, &split.Branch2),
+			Start: split,
+			Out:   append(subfragment.Out, exit),
 		}
 		return frag, nil
-	case *ast.CharacterSetNode:
-		var characterClassesMatchers []matcher.PredefinedClassMatcher
-		for _, characterClass := range node.CharacterClasses {
-			var m matcher.PredefinedClassMatcher
-			switch characterClass {
-			case predefinedclass.ClassDigit:
-				m = &matcher.DigitMatcher{}
-			case predefinedclass.ClassAlphanumeric:
-				m = &matcher.AlphaNumericMatcher{}
-			}
-			characterClassesMatchers = append(characterClassesMatchers, m)
+	case *ast.RepetitionNode:
+		expanded := expandRepetition(node)
+		if expanded == nil {
+			return newEmptyFragment(), nil
 		}
-		characterSetMatcher := &matcher.CharacterSetMatcher{
-			IsPositive:               node.IsPositive,
-			Literals:                 node.Literals,
-			Ranges:                   node.Ranges,
-			CharacterClassesMatchers: characterClassesMatchers,
+		return processNode(expanded)
+	case *ast.CharacterSetNode:
+		characterSetMatcher, err := newCharacterSetMatcher(node)
+		if err != nil {
+			return nfa.Fragment{}, err
 		}
 		return newMatcherFragment(characterSetMatcher), nil
 	case *ast.LiteralNode:
-		return newMatcherFragment(&matcher.LiteralMatcher{Literal: node.Literal}), nil
+		literalMatcher := &matcher.LiteralMatcher{
+			Literal:         node.Literal,
+			CaseInsensitive: node.CaseInsensitive,
+		}
+		return newMatcherFragment(literalMatcher), nil
 	case *ast.WildcardNode:
+		if node.DotAll {
+			return newMatcherFragment(&matcher.AnyMatcher{}), nil
+		}
 		return newMatcherFragment(&matcher.WildcardMatcher{}), nil
 	case *ast.DigitNode:
 		return newMatcherFragment(&matcher.DigitMatcher{}), nil
 	case *ast.AlphaNumericNode:
 		return newMatcherFragment(&matcher.AlphaNumericMatcher{}), nil
-	case *ast.StartAnchorNode:
-		s := &nfa.StartAnchorState{
-			Out: nil,
+	case *ast.WhitespaceNode:
+		return newMatcherFragment(&matcher.WhitespaceMatcher{}), nil
+	case *ast.NonDigitNode:
+		return newMatcherFragment(&matcher.NegatedClassMatcher{Class: &matcher.DigitMatcher{}}), nil
+	case *ast.NonAlphaNumericNode:
+		return newMatcherFragment(&matcher.NegatedClassMatcher{Class: &matcher.AlphaNumericMatcher{}}), nil
+	case *ast.NonWhitespaceNode:
+		return newMatcherFragment(&matcher.NegatedClassMatcher{Class: &matcher.WhitespaceMatcher{}}), nil
+	case *ast.UnicodeClassNode:
+		m, err := newUnicodeClassMatcher(node.Name, node.Negated)
+		if err != nil {
+			return nfa.Fragment{}, err
+		}
+		return newMatcherFragment(m), nil
+	case *ast.AnchorNode:
+		s := &nfa.AnchorState{
+			Out:  nil,
+			Kind: node.Kind,
+		}
+		frag := nfa.Fragment{
+			Start: s,
+			Out:   []*nfa.State{&s.Out},
+		}
+		return frag, nil
+	case *ast.WordBoundaryNode:
+		s := &nfa.WordBoundaryState{
+			Out:  nil,
+			Kind: node.Kind,
 		}
 		frag := nfa.Fragment{
 			Start: s,
 			Out:   []*nfa.State{&s.Out},
 		}
 		return frag, nil
-	case *ast.EndAnchorNode:
-		s := &nfa.EndAnchorState{
-			Out: nil,
+	case *ast.EmptyNode:
+		return newEmptyFragment(), nil
+	case *ast.BackReferenceNode:
+		s := &nfa.BackReferenceState{
+			Out:             nil,
+			GroupIndex:      node.GroupIndex,
+			CaseInsensitive: node.CaseInsensitive,
+		}
+		frag := nfa.Fragment{
+			Start: s,
+			Out:   []*nfa.State{&s.Out},
+		}
+		return frag, nil
+	case *ast.SubroutineCallNode:
+		s := &nfa.SubroutineCallState{
+			Out:        nil,
+			GroupIndex: node.GroupIndex,
 		}
 		frag := nfa.Fragment{
 			Start: s,
@@ -170,10 +504,87 @@ func processNode(n ast.ASTNode) (nfa.Fragment, error) {
 	}
 }
 
+// linkSubroutineCalls points every subroutine call reachable from start at
+// the start state of the group it calls. A group that was copied by a
+// counted repetition has several start states, and any of them will do,
+// since a call returns as soon as it reaches the end of the group.
+func linkSubroutineCalls(start nfa.State) {
+	groupStarts := map[int]nfa.State{}
+	var calls []*nfa.SubroutineCallState
+
+	seen := map[nfa.State]bool{}
+	pending := []nfa.State{start}
+	for len(pending) > 0 {
+		s := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if s == nil || seen[s] {
+			continue
+		}
+		seen[s] = true
+
+		switch st := s.(type) {
+		case *nfa.CaptureStartState:
+			if _, ok := groupStarts[st.GroupIndex]; !ok {
+				groupStarts[st.GroupIndex] = st
+			}
+		case *nfa.SubroutineCallState:
+			calls = append(calls, st)
+		}
+		pending = append(pending, nfa.Successors(s)...)
+	}
+
+	for _, call := range calls {
+		call.Target = groupStarts[call.GroupIndex]
+	}
+}
+
 func Build(tree ast.ASTNode) (nfa.Fragment, error) {
+	return BuildAll([]ast.ASTNode{tree})
+}
+
+// BuildAll builds a single NFA that matches wherever any of the trees does,
+// so a line can be scanned once for all of them. Each tree is wrapped in its
+// own capture group 0, as Build does for one, and the results are joined
+// with SplitStates that prefer the earlier trees. The trees keep their own
+// group numbers, so their captures share slots.
+func BuildAll(trees []ast.ASTNode) (nfa.Fragment, error) {
+	if len(trees) == 0 {
+		return nfa.Fragment{}, fmt.Errorf("no patterns to build")
+	}
+
+	acceptingState := &nfa.AcceptingState{}
+	var start nfa.State
+	for i := len(trees) - 1; i >= 0; i-- {
+		patternStart, err := buildPattern(trees[i], acceptingState)
+		if err != nil {
+			return nfa.Fragment{}, err
+		}
+		if start == nil {
+			start = patternStart
+		} else {
+			start = &nfa.SplitState{
+				Branch1: patternStart,
+				Branch2: start,
+			}
+		}
+	}
+
+	finalFragment := nfa.Fragment{
+		Start: start,
+		Out:   []*nfa.State{},
+	}
+
+	return finalFragment, nil
+}
+
+// buildPattern builds the NFA for one whole pattern, wrapped in capture
+// group 0 and ending in acceptingState, and returns its start state. Its
+// subroutine calls are linked before it is joined to other patterns, so
+// they only reach groups of the same pattern.
+func buildPattern(tree ast.ASTNode, acceptingState *nfa.AcceptingState) (nfa.State, error) {
 	mainFrag, err := processNode(tree)
 	if err != nil {
-		return nfa.Fragment{}, err
+		return nil, err
 	}
 
 	startState := &nfa.CaptureStartState{
@@ -185,14 +596,9 @@ func Build(tree ast.ASTNode) (nfa.Fragment, error) {
 		Out:        nil,
 	}
 	nfa.SetStates(mainFrag.Out, endState)
-
-	acceptingState := &nfa.AcceptingState{}
 	nfa.SetStates([]*nfa.State{&endState.Out}, acceptingState)
 
-	finalFragment := nfa.Fragment{
-		Start: startState,
-		Out:   []*nfa.State{},
-	}
+	linkSubroutineCalls(startState)
 
-	return finalFragment, nil
+	return startState, nil
 }
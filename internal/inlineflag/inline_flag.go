@@ -0,0 +1,39 @@
+// Package inlineflag defines the modifiers that can be switched on and off
+// inside a pattern with (?flags) and (?flags:...)
+package inlineflag
+
+type Flags uint8
+
+const (
+	// CaseInsensitive (i) matches letters regardless of case.
+	CaseInsensitive Flags = 1 << iota
+	// Multiline (m) lets ^ and $ match around every newline.
+	Multiline
+	// DotAll (s) lets . match a newline.
+	DotAll
+	// Extended (x) ignores whitespace and # comments in the pattern.
+	Extended
+)
+
+var letters = map[rune]Flags{
+	'i': CaseInsensitive,
+	'm': Multiline,
+	's': DotAll,
+	'x': Extended,
+}
+
+// FromLetter returns the flag written as letter in a pattern.
+func FromLetter(letter rune) (Flags, bool) {
+	flag, ok := letters[letter]
+	return flag, ok
+}
+
+// Has reports whether every flag in flag is set in f.
+func (f Flags) Has(flag Flags) bool {
+	return f&flag == flag
+}
+
+// Apply returns f with the flags in on set and the flags in off cleared.
+func (f Flags) Apply(on Flags, off Flags) Flags {
+	return f&^off | on
+}
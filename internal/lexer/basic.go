@@ -0,0 +1,165 @@
+package lexer
+
+import (
+	"fmt"
+
+	"github.com/mmarchesotti/build-your-own-grep/internal/inlineflag"
+	"github.com/mmarchesotti/build-your-own-grep/internal/token"
+)
+
+// TokenizeBasic tokenizes a POSIX basic regular expression, the syntax grep
+// uses by default. In it \( \) \{ \} \| \+ and \? are operators, and the
+// bare characters stand for themselves. A * is literal at the start of the
+// pattern, of a group or of an alternative, and ^ and $ are only anchors at
+// those starts and at the matching ends. Bracket expressions have no && and
+// -- operators, as in POSIX. Everything else, other escapes included, reads
+// as in Tokenize, which produces the tokens once the pattern has been
+// rewritten in that syntax.
+func TokenizeBasic(inputPattern string, flags inlineflag.Flags) ([]token.Token, error) {
+	pattern, err := decodePattern(inputPattern)
+	if err != nil {
+		return nil, err
+	}
+	translated, err := translateBasic(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return tokenize(translated, flags, false)
+}
+
+// isBasicOperator reports whether r is one of the characters that are
+// operators when escaped in a basic regular expression, and literals
+// otherwise.
+func isBasicOperator(r rune) bool {
+	switch r {
+	case '(', ')', '{', '}', '|', '+', '?':
+		return true
+	default:
+		return false
+	}
+}
+
+// translateBasic rewrites a basic regular expression in the extended syntax
+// that Tokenize reads.
+func translateBasic(pattern []rune) ([]rune, error) {
+	translated := make([]rune, 0, len(pattern))
+	// atExpressionStart is set where a * is literal and a ^ is an anchor.
+	atExpressionStart := true
+	for index := 0; index < len(pattern); index++ {
+		r := pattern[index]
+		startsExpression := false
+		switch {
+		case r == '\\' && index+1 < len(pattern):
+			next := pattern[index+1]
+			switch {
+			case next == '{' && !hasBasicIntervalEnd(pattern[index+2:]):
+				return nil, fmt.Errorf("unmatched \\{")
+			case isBasicOperator(next):
+				translated = append(translated, next)
+				startsExpression = next == '(' || next == '|'
+			case isBracedEscape(next):
+				// The braces of \p{...}, \x{...} and \g{...} belong to the
+				// escape. One that does not parse is copied to the end, for
+				// Tokenize to report.
+				width, err := readBracedEscape(pattern[index+1:])
+				if err != nil {
+					width = len(pattern) - index - 1
+				}
+				translated = append(translated, pattern[index:index+1+width]...)
+				index += width - 1
+			case next == 'Q':
+				_, width := readQuotedSpan(pattern[index+2:])
+				translated = append(translated, pattern[index:index+2+width]...)
+				index += width
+			default:
+				translated = append(translated, r, next)
+			}
+			index++
+		case isBasicOperator(r):
+			translated = append(translated, '\\', r)
+		case r == '*' && atExpressionStart:
+			translated = append(translated, '\\', r)
+		case r == '^':
+			if atExpressionStart {
+				translated = append(translated, r)
+				startsExpression = true
+			} else {
+				translated = append(translated, '\\', r)
+			}
+		case r == '$':
+			if isAtBasicExpressionEnd(pattern[index+1:]) {
+				translated = append(translated, r)
+			} else {
+				translated = append(translated, '\\', r)
+			}
+		case r == '[':
+			// Bracket expressions are copied as they are, and read
+			// without set operators. One that does not parse is copied to
+			// the end, for tokenize to report.
+			_, width, err := tokenizeCharacterSet(pattern[index:], false)
+			if err != nil {
+				width = len(pattern) - index
+			}
+			translated = append(translated, pattern[index:index+width]...)
+			index += width - 1
+		default:
+			translated = append(translated, r)
+		}
+		atExpressionStart = startsExpression
+	}
+	return translated, nil
+}
+
+// hasBasicIntervalEnd reports whether rest, the part of a basic regular
+// expression after a \{, contains the \} that closes the interval.
+func hasBasicIntervalEnd(rest []rune) bool {
+	for index := 0; index+1 < len(rest); index++ {
+		if rest[index] == '\\' {
+			if rest[index+1] == '}' {
+				return true
+			}
+			index++
+		}
+	}
+	return false
+}
+
+// isBracedEscape reports whether r, following a backslash, starts an escape
+// that may carry its own braces.
+func isBracedEscape(r rune) bool {
+	switch r {
+	case 'p', 'P', 'x', 'g', 'k':
+		return true
+	default:
+		return false
+	}
+}
+
+// readBracedEscape returns the number of runes spanned by the escape at the
+// start of pattern, which begins just after the backslash at one of the
+// letters isBracedEscape accepts.
+func readBracedEscape(pattern []rune) (int, error) {
+	switch pattern[0] {
+	case 'p', 'P':
+		_, width, err := readUnicodeProperty(pattern)
+		return width, err
+	case 'x':
+		_, width, err := readHexEscape(pattern)
+		return width, err
+	case 'g':
+		_, _, width, err := readGroupReference(pattern)
+		return width, err
+	default:
+		_, width, err := readGroupName(pattern[1:], "\\k")
+		return width + 1, err
+	}
+}
+
+// isAtBasicExpressionEnd reports whether rest, the part of a basic regular
+// expression after a $, ends the pattern, a group or an alternative.
+func isAtBasicExpressionEnd(rest []rune) bool {
+	if len(rest) == 0 {
+		return true
+	}
+	return len(rest) >= 2 && rest[0] == '\\' && (rest[1] == ')' || rest[1] == '|')
+}
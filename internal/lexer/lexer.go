@@ -3,106 +3,948 @@ package lexer
 
 import (
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/mmarchesotti/build-your-own-grep/internal/anchor"
+	"github.com/mmarchesotti/build-your-own-grep/internal/boundary"
+	"github.com/mmarchesotti/build-your-own-grep/internal/inlineflag"
 	"github.com/mmarchesotti/build-your-own-grep/internal/predefinedclass"
 	"github.com/mmarchesotti/build-your-own-grep/internal/token"
 )
 
+// maxRepetition is the largest bound accepted in a counted repetition.
+const maxRepetition = 1000
+
 func Tokenize(inputPattern string) ([]token.Token, error) {
-	tokens := make([]token.Token, 0, len(inputPattern))
+	return TokenizeWithFlags(inputPattern, 0)
+}
+
+// TokenizeWithFlags is like Tokenize, but starts with the given inline flags
+// in effect, as if the pattern began with them. Only Extended changes how
+// the pattern is tokenized; the others are left for the parser and must be
+// passed to it separately.
+func TokenizeWithFlags(inputPattern string, flags inlineflag.Flags) ([]token.Token, error) {
+	pattern, err := decodePattern(inputPattern)
+	if err != nil {
+		return nil, err
+	}
+	return tokenize(pattern, flags, true)
+}
+
+// tokenize produces the tokens of a decoded pattern. The && and -- operators
+// are only read in bracket expressions when setOperators is set.
+func tokenize(pattern []rune, flags inlineflag.Flags, setOperators bool) ([]token.Token, error) {
+	tokens := make([]token.Token, 0, len(pattern))
+	// scopeFlags holds the inline flags of every open group, innermost
+	// last. The lexer only acts on (?x); the parser handles the others.
+	scopeFlags := []inlineflag.Flags{flags}
+	// relative holds the \g{-N} references, whose CaptureIndex holds N
+	// until they are resolved against the groups opened before them.
+	relative := map[*token.BackReference]bool{}
 
-	for inputIndex := 0; inputIndex < len(inputPattern); inputIndex++ {
-		currentCharacter := inputPattern[inputIndex]
+	for inputIndex := 0; inputIndex < len(pattern); inputIndex++ {
+		currentCharacter := pattern[inputIndex]
 		var newToken token.Token
 
+		if scopeFlags[len(scopeFlags)-1].Has(inlineflag.Extended) {
+			if unicode.IsSpace(currentCharacter) {
+				continue
+			}
+			if currentCharacter == '#' {
+				for inputIndex+1 < len(pattern) && pattern[inputIndex+1] != '\n' {
+					inputIndex++
+				}
+				continue
+			}
+		}
+
 		switch currentCharacter {
 		case '\\':
-			if inputIndex+1 >= len(inputPattern) {
+			if inputIndex+1 >= len(pattern) {
 				return nil, fmt.Errorf("dangling backslash")
 			}
-			nextCharacter := inputPattern[inputIndex+1]
+			nextCharacter := pattern[inputIndex+1]
 			switch nextCharacter {
 			case 'd':
 				newToken = &token.Digit{}
 			case 'w':
 				newToken = &token.AlphaNumeric{}
+			case 's':
+				newToken = &token.Whitespace{}
+			case 'D':
+				newToken = &token.NonDigit{}
+			case 'W':
+				newToken = &token.NonAlphaNumeric{}
+			case 'S':
+				newToken = &token.NonWhitespace{}
+			case 'A':
+				newToken = &token.Anchor{Kind: anchor.TextStart}
+			case 'z':
+				newToken = &token.Anchor{Kind: anchor.TextEnd}
+			case 'Z':
+				newToken = &token.Anchor{Kind: anchor.TextEndBeforeNewline}
+			case 'b':
+				newToken = &token.WordBoundary{Kind: boundary.WordBoundary}
+			case 'B':
+				newToken = &token.WordBoundary{Kind: boundary.NonWordBoundary}
+			case '<':
+				newToken = &token.WordBoundary{Kind: boundary.WordStart}
+			case '>':
+				newToken = &token.WordBoundary{Kind: boundary.WordEnd}
+			case 'p', 'P':
+				property, width, err := readUnicodeProperty(pattern[inputIndex+1:])
+				if err != nil {
+					return nil, err
+				}
+				newToken = &token.UnicodeClass{Name: property.Name, Negated: property.Negated}
+				inputIndex += width - 1
+			case 'k':
+				name, width, err := readGroupName(pattern[inputIndex+2:], "\\k")
+				if err != nil {
+					return nil, err
+				}
+				newToken = &token.BackReference{Name: name}
+				inputIndex += width
+			case 'g':
+				reference, isRelative, width, err := readGroupReference(pattern[inputIndex+1:])
+				if err != nil {
+					return nil, err
+				}
+				if isRelative {
+					relative[reference] = true
+				}
+				newToken = reference
+				inputIndex += width - 1
 			case '1', '2', '3', '4', '5', '6', '7', '8', '9':
-				newToken = &token.BackReference{CaptureIndex: int(nextCharacter - '0')}
+				digitsEnd := inputIndex + 2
+				for digitsEnd < len(pattern) && isDigit(pattern[digitsEnd]) {
+					digitsEnd++
+				}
+				digits := string(pattern[inputIndex+1 : digitsEnd])
+				captureIndex, err := strconv.Atoi(digits)
+				if err != nil {
+					return nil, fmt.Errorf("invalid backreference \\%s", digits)
+				}
+				newToken = &token.BackReference{CaptureIndex: captureIndex}
+				inputIndex += len(digits) - 1
+			case 'Q':
+				quoted, width := readQuotedSpan(pattern[inputIndex+2:])
+				for _, r := range quoted {
+					tokens = append(tokens, &token.Literal{Literal: r})
+				}
+				inputIndex += width + 1
+				continue
+			case 'E':
+				// A \E without an opening \Q ends nothing and is ignored.
+				inputIndex += 1
+				continue
 			default:
-				newToken = &token.Literal{Literal: rune(nextCharacter)}
+				literal, width, err := readCharacterEscape(pattern[inputIndex+1:])
+				if err != nil {
+					return nil, err
+				}
+				newToken = &token.Literal{Literal: literal}
+				inputIndex += width - 1
 			}
 			inputIndex += 1
 		case '[':
-			distanceToClosing := strings.Index(inputPattern[inputIndex:], "]")
-			if distanceToClosing == -1 {
-				return nil, fmt.Errorf("unmatched character set opener [")
-			}
-
-			var setLiterals []rune
-			var characterClasses []predefinedclass.PredefinedClass
-			setCharacters := inputPattern[inputIndex+1 : inputIndex+distanceToClosing]
-			inputIndex += distanceToClosing
-
-			startingSetIndex := 0
-			negated := len(setCharacters) > 0 && setCharacters[0] == '^'
-			if negated {
-				startingSetIndex = 1
-			}
-
-			for setIndex := startingSetIndex; setIndex < len(setCharacters); setIndex++ {
-				currentGroupCharacter := setCharacters[setIndex]
-
-				if currentGroupCharacter == '\\' {
-					if setIndex+1 >= len(setCharacters) {
-						return nil, fmt.Errorf("dangling backslash inside character set")
-					}
-					nextCharacter := setCharacters[setIndex+1]
-					switch nextCharacter {
-					case 'd':
-						characterClasses = append(characterClasses, predefinedclass.ClassDigit)
-					case 'w':
-						characterClasses = append(characterClasses, predefinedclass.ClassAlphanumeric)
-					default:
-						setLiterals = append(setLiterals, rune(nextCharacter))
-					}
-					setIndex += 1
-				} else {
-					setLiterals = append(setLiterals, rune(setCharacters[setIndex]))
-				}
-			}
-
-			newToken = &token.CharacterSet{
-				IsPositive:       !negated,
-				CharacterClasses: characterClasses,
-				Literals:         setLiterals,
+			characterSet, width, err := tokenizeCharacterSet(pattern[inputIndex:], setOperators)
+			if err != nil {
+				return nil, err
 			}
-
+			newToken = characterSet
+			inputIndex += width - 1
 		case '^':
 			newToken = &token.StartAnchor{}
 		case '$':
 			newToken = &token.EndAnchor{}
 		case '*':
-			newToken = &token.KleeneClosure{}
+			lazy, possessive := readQuantifierSuffix(pattern, &inputIndex)
+			newToken = &token.KleeneClosure{Lazy: lazy, Possessive: possessive}
 		case '+':
-			newToken = &token.PositiveClosure{}
+			lazy, possessive := readQuantifierSuffix(pattern, &inputIndex)
+			newToken = &token.PositiveClosure{Lazy: lazy, Possessive: possessive}
 		case '?':
-			newToken = &token.OptionalQuantifier{}
+			lazy, possessive := readQuantifierSuffix(pattern, &inputIndex)
+			newToken = &token.OptionalQuantifier{Lazy: lazy, Possessive: possessive}
+		case '{':
+			repetition, width, err := tokenizeRepetition(pattern[inputIndex:])
+			if err != nil {
+				return nil, err
+			}
+			if repetition == nil {
+				newToken = &token.Literal{Literal: '{'}
+			} else {
+				inputIndex += width - 1
+				repetition.Lazy, repetition.Possessive = readQuantifierSuffix(pattern, &inputIndex)
+				newToken = repetition
+			}
 		case '.':
 			newToken = &token.Wildcard{}
 		case '|':
 			newToken = &token.Alternation{}
 		case '(':
-			newToken = &token.GroupingOpener{}
+			// A (?#...) comment is dropped, whatever the flags.
+			if inputIndex+2 < len(pattern) && pattern[inputIndex+1] == '?' && pattern[inputIndex+2] == '#' {
+				closingIndex := slices.Index(pattern[inputIndex:], ')')
+				if closingIndex == -1 {
+					return nil, fmt.Errorf("missing ) after comment")
+				}
+				inputIndex += closingIndex
+				continue
+			}
+			opener, width, err := tokenizeGroupOpener(pattern[inputIndex:])
+			if err != nil {
+				return nil, err
+			}
+			switch opener := opener.(type) {
+			case *token.InlineFlags:
+				current := &scopeFlags[len(scopeFlags)-1]
+				*current = current.Apply(opener.On, opener.Off)
+			case *token.GroupingOpener:
+				current := scopeFlags[len(scopeFlags)-1]
+				scopeFlags = append(scopeFlags, current.Apply(opener.FlagsOn, opener.FlagsOff))
+			}
+			newToken = opener
+			inputIndex += width - 1
 		case ')':
+			if len(scopeFlags) > 1 {
+				scopeFlags = scopeFlags[:len(scopeFlags)-1]
+			}
 			newToken = &token.GroupingCloser{}
 		default:
 			newToken = &token.Literal{
-				Literal: rune(inputPattern[inputIndex]),
+				Literal: currentCharacter,
 			}
 		}
 		tokens = append(tokens, newToken)
 	}
 
+	if err := resolveRelativeReferences(tokens, relative); err != nil {
+		return nil, err
+	}
 	return tokens, nil
 }
+
+// resolveRelativeReferences turns the relative references in tokens into
+// absolute ones, counting back from the groups opened before each of them.
+func resolveRelativeReferences(tokens []token.Token, relative map[*token.BackReference]bool) error {
+	if len(relative) == 0 {
+		return nil
+	}
+
+	openedGroups := 0
+	for _, t := range tokens {
+		switch t := t.(type) {
+		case *token.GroupingOpener:
+			if t.Kind == token.GroupCapturing {
+				openedGroups++
+			}
+		case *token.BackReference:
+			if relative[t] {
+				if t.CaptureIndex > openedGroups {
+					return fmt.Errorf("relative reference \\g{-%d} points before the first group", t.CaptureIndex)
+				}
+				t.CaptureIndex = openedGroups - t.CaptureIndex + 1
+			}
+		}
+	}
+	return nil
+}
+
+// readQuantifierSuffix looks past the quantifier that ends at *index for a
+// '?' that makes it lazy or a '+' that makes it possessive, and advances
+// *index over the suffix when there is one.
+func readQuantifierSuffix(pattern []rune, index *int) (lazy bool, possessive bool) {
+	if *index+1 >= len(pattern) {
+		return false, false
+	}
+	switch pattern[*index+1] {
+	case '?':
+		*index++
+		return true, false
+	case '+':
+		*index++
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// decodePattern splits the pattern into runes, rejecting invalid UTF-8.
+func decodePattern(inputPattern string) ([]rune, error) {
+	pattern := make([]rune, 0, len(inputPattern))
+	for byteIndex := 0; byteIndex < len(inputPattern); {
+		r, size := utf8.DecodeRuneInString(inputPattern[byteIndex:])
+		if r == utf8.RuneError && size <= 1 {
+			return nil, fmt.Errorf("invalid UTF-8 in pattern at byte %d", byteIndex)
+		}
+		pattern = append(pattern, r)
+		byteIndex += size
+	}
+	return pattern, nil
+}
+
+// tokenizeRepetition parses a counted repetition at the start of pattern,
+// which must begin with '{'. It returns the token and the number of runes it
+// spans. A nil token means the brace does not open a repetition and should be
+// read as a literal.
+func tokenizeRepetition(pattern []rune) (*token.RepetitionQuantifier, int, error) {
+	if len(pattern) < 2 || !(isDigit(pattern[1]) || pattern[1] == ',') {
+		return nil, 0, nil
+	}
+
+	closingIndex := slices.Index(pattern, '}')
+	if closingIndex == -1 {
+		return nil, 0, fmt.Errorf("unmatched repetition opener {")
+	}
+	bounds := string(pattern[1:closingIndex])
+
+	minText, maxText, hasComma := strings.Cut(bounds, ",")
+	lower, err := parseRepetitionBound(minText, 0, bounds)
+	if err != nil {
+		return nil, 0, err
+	}
+	upper := lower
+	if hasComma {
+		upper, err = parseRepetitionBound(maxText, -1, bounds)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if upper != -1 && lower > upper {
+		return nil, 0, fmt.Errorf("invalid repetition {%s}: minimum greater than maximum", bounds)
+	}
+
+	return &token.RepetitionQuantifier{Min: lower, Max: upper}, closingIndex + 1, nil
+}
+
+func parseRepetitionBound(text string, fallback int, bounds string) (int, error) {
+	if text == "" {
+		return fallback, nil
+	}
+	for _, c := range text {
+		if !isDigit(c) {
+			return 0, fmt.Errorf("invalid repetition {%s}", bounds)
+		}
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil || value > maxRepetition {
+		return 0, fmt.Errorf("invalid repetition {%s}: bound exceeds %d", bounds, maxRepetition)
+	}
+	return value, nil
+}
+
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c rune) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// setMember is a single element of a bracket expression: a literal
+// character, a predefined class such as \d or a Unicode property.
+type setMember struct {
+	literal    rune
+	class      predefinedclass.PredefinedClass
+	isClass    bool
+	property   predefinedclass.UnicodeProperty
+	isProperty bool
+}
+
+// tokenizeCharacterSet parses a bracket expression at the start of pattern,
+// which must begin with '['. It returns the token and the number of runes it
+// spans. A ']' directly after the opener (or after '^') is a literal member,
+// as is a '-' at either end of the set.
+//
+// The members may be followed by && and -- operators, which intersect the
+// set with, or subtract from it, the operand that follows. An operand is
+// either a nested bracket expression, as in [a-z&&[^aeiou]], or the members
+// up to the next operator or the closing ']', as in [\w--\d]. Without
+// setOperators, && and -- are ordinary members and ranges, as in POSIX.
+func tokenizeCharacterSet(pattern []rune, setOperators bool) (*token.CharacterSet, int, error) {
+	readOperator := readSetOperator
+	if !setOperators {
+		readOperator = func([]rune) string { return "" }
+	}
+
+	characterSet := &token.CharacterSet{IsPositive: true}
+
+	setIndex := 1
+	if setIndex < len(pattern) && pattern[setIndex] == '^' {
+		characterSet.IsPositive = false
+		setIndex++
+	}
+
+	// current is the set that members are added to: the set itself until
+	// the first operator, and then the operand being read. It is nil after
+	// a nested operand, which must be followed by an operator or the end.
+	current := characterSet
+	operator := ""
+	for isFirst := true; ; isFirst = false {
+		if setIndex >= len(pattern) {
+			return nil, 0, fmt.Errorf("unmatched character set opener [")
+		}
+		if pattern[setIndex] == ']' && !isFirst {
+			if current != nil && isEmptySet(current) {
+				return nil, 0, fmt.Errorf("missing operand after %s in character set", operator)
+			}
+			return characterSet, setIndex + 1, nil
+		}
+		if next := readOperator(pattern[setIndex:]); next != "" && !isFirst {
+			if current != nil && isEmptySet(current) {
+				return nil, 0, fmt.Errorf("missing operand before %s in character set", next)
+			}
+			operator = next
+			setIndex += len(operator)
+
+			operand := &token.CharacterSet{IsPositive: true}
+			current = operand
+			if isNestedSet(pattern[setIndex:]) {
+				nested, width, err := tokenizeCharacterSet(pattern[setIndex:], setOperators)
+				if err != nil {
+					return nil, 0, err
+				}
+				operand = nested
+				current = nil
+				setIndex += width
+			}
+			if operator == "&&" {
+				characterSet.Intersect = append(characterSet.Intersect, operand)
+			} else {
+				characterSet.Subtract = append(characterSet.Subtract, operand)
+			}
+			continue
+		}
+		if current == nil {
+			return nil, 0, fmt.Errorf("expected ] or set operator after nested character set")
+		}
+		if pattern[setIndex] == '\\' && setIndex+1 < len(pattern) && pattern[setIndex+1] == 'Q' {
+			quoted, width := readQuotedSpan(pattern[setIndex+2:])
+			current.Literals = append(current.Literals, quoted...)
+			setIndex += width + 2
+			continue
+		}
+
+		member, width, err := readSetMember(pattern[setIndex:])
+		if err != nil {
+			return nil, 0, err
+		}
+		setIndex += width
+
+		isRange := !member.isClass && !member.isProperty &&
+			setIndex+1 < len(pattern) &&
+			pattern[setIndex] == '-' &&
+			pattern[setIndex+1] != ']' &&
+			readOperator(pattern[setIndex:]) == ""
+		if !isRange {
+			switch {
+			case member.isClass:
+				current.CharacterClasses = append(current.CharacterClasses, member.class)
+			case member.isProperty:
+				current.UnicodeProperties = append(current.UnicodeProperties, member.property)
+			default:
+				current.Literals = append(current.Literals, member.literal)
+			}
+			continue
+		}
+
+		upperMember, width, err := readSetMember(pattern[setIndex+1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		setIndex += width + 1
+
+		if upperMember.isClass || upperMember.isProperty {
+			return nil, 0, fmt.Errorf("invalid character range: class used as range endpoint")
+		}
+		if member.literal > upperMember.literal {
+			return nil, 0, fmt.Errorf("invalid character range %c-%c", member.literal, upperMember.literal)
+		}
+		current.Ranges = append(current.Ranges, [2]rune{member.literal, upperMember.literal})
+	}
+}
+
+// readSetOperator returns the && or -- operator at the start of pattern, or
+// "" if there is none. An operator right before the closing ']' is not one,
+// so [a&&] and [!--] keep their meaning as plain members and ranges.
+func readSetOperator(pattern []rune) string {
+	if len(pattern) < 3 || pattern[2] == ']' {
+		return ""
+	}
+	switch string(pattern[:2]) {
+	case "&&", "--":
+		return string(pattern[:2])
+	default:
+		return ""
+	}
+}
+
+// isNestedSet reports whether pattern starts with a nested bracket
+// expression, as opposed to a [:name:], [=x=] or [.x.] term.
+func isNestedSet(pattern []rune) bool {
+	if len(pattern) == 0 || pattern[0] != '[' {
+		return false
+	}
+	return len(pattern) < 2 || (pattern[1] != ':' && pattern[1] != '=' && pattern[1] != '.')
+}
+
+// isEmptySet reports whether a bracket expression has no members and no
+// operands.
+func isEmptySet(set *token.CharacterSet) bool {
+	return len(set.Literals) == 0 && len(set.Ranges) == 0 &&
+		len(set.CharacterClasses) == 0 && len(set.UnicodeProperties) == 0 &&
+		len(set.Intersect) == 0 && len(set.Subtract) == 0
+}
+
+// setClassEscapes maps the escapes allowed inside a bracket expression to
+// the predefined class they stand for.
+var setClassEscapes = map[rune]predefinedclass.PredefinedClass{
+	'd': predefinedclass.ClassDigit,
+	'w': predefinedclass.ClassAlphanumeric,
+	's': predefinedclass.ClassWhitespace,
+	'D': predefinedclass.ClassNonDigit,
+	'W': predefinedclass.ClassNonAlphanumeric,
+	'S': predefinedclass.ClassNonWhitespace,
+}
+
+// posixClasses maps the names accepted in [:name:] to their predefined class.
+var posixClasses = map[string]predefinedclass.PredefinedClass{
+	"alnum":  predefinedclass.ClassAlnum,
+	"alpha":  predefinedclass.ClassAlpha,
+	"blank":  predefinedclass.ClassBlank,
+	"cntrl":  predefinedclass.ClassCntrl,
+	"digit":  predefinedclass.ClassDigit,
+	"graph":  predefinedclass.ClassGraph,
+	"lower":  predefinedclass.ClassLower,
+	"print":  predefinedclass.ClassPrint,
+	"punct":  predefinedclass.ClassPunct,
+	"space":  predefinedclass.ClassWhitespace,
+	"upper":  predefinedclass.ClassUpper,
+	"xdigit": predefinedclass.ClassXDigit,
+}
+
+// readSetMember reads one member of a bracket expression and returns it along
+// with the number of runes it spans.
+func readSetMember(pattern []rune) (setMember, int, error) {
+	if pattern[0] == '[' && len(pattern) > 1 {
+		switch pattern[1] {
+		case ':', '=', '.':
+			return readBracketTerm(pattern)
+		}
+	}
+	if pattern[0] != '\\' {
+		return setMember{literal: pattern[0]}, 1, nil
+	}
+	if len(pattern) < 2 {
+		return setMember{}, 0, fmt.Errorf("dangling backslash inside character set")
+	}
+	if class, ok := setClassEscapes[pattern[1]]; ok {
+		return setMember{class: class, isClass: true}, 2, nil
+	}
+	if pattern[1] == 'p' || pattern[1] == 'P' {
+		property, width, err := readUnicodeProperty(pattern[1:])
+		if err != nil {
+			return setMember{}, 0, err
+		}
+		return setMember{property: property, isProperty: true}, width + 1, nil
+	}
+	if pattern[1] == 'b' {
+		// Inside a bracket expression \b is a backspace, not a boundary.
+		return setMember{literal: '\b'}, 2, nil
+	}
+	literal, width, err := readCharacterEscape(pattern[1:])
+	if err != nil {
+		return setMember{}, 0, err
+	}
+	return setMember{literal: literal}, width + 1, nil
+}
+
+// controlEscapes maps the letters of the control-character escapes to the
+// rune they stand for.
+var controlEscapes = map[rune]rune{
+	'a': '\a',
+	'e': 0x1b,
+	'f': '\f',
+	'n': '\n',
+	'r': '\r',
+	't': '\t',
+	'v': '\v',
+}
+
+// readCharacterEscape reads an escape that stands for a single rune from the
+// start of pattern, which begins just after the backslash. It understands
+// the control escapes, hexadecimal \xHH and \x{HHHHHH}, and octal \0oo. Any
+// other ASCII letter is rejected, and any other character stands for itself.
+// It returns the rune and the number of runes the escape spans.
+func readCharacterEscape(pattern []rune) (rune, int, error) {
+	escaped := pattern[0]
+	if r, ok := controlEscapes[escaped]; ok {
+		return r, 1, nil
+	}
+
+	switch {
+	case escaped == 'x':
+		return readHexEscape(pattern)
+	case escaped == '0':
+		value := 0
+		width := 1
+		for width < 3 && width < len(pattern) && pattern[width] >= '0' && pattern[width] <= '7' {
+			value = value*8 + int(pattern[width]-'0')
+			width++
+		}
+		return rune(value), width, nil
+	case escaped < utf8.RuneSelf && unicode.IsLetter(escaped):
+		return 0, 0, fmt.Errorf("unknown escape sequence \\%c", escaped)
+	default:
+		return escaped, 1, nil
+	}
+}
+
+// readHexEscape reads \xHH, with one or two hex digits, or \x{H...} from the
+// start of pattern, which begins at the 'x'.
+func readHexEscape(pattern []rune) (rune, int, error) {
+	var digits []rune
+	width := 1
+	if len(pattern) > 1 && pattern[1] == '{' {
+		closingIndex := slices.Index(pattern, '}')
+		if closingIndex == -1 {
+			return 0, 0, fmt.Errorf("unterminated \\x{")
+		}
+		digits = pattern[2:closingIndex]
+		width = closingIndex + 1
+	} else {
+		for width < 3 && width < len(pattern) && isHexDigit(pattern[width]) {
+			width++
+		}
+		digits = pattern[1:width]
+	}
+
+	if len(digits) == 0 {
+		return 0, 0, fmt.Errorf("missing hexadecimal digits after \\x")
+	}
+	value, err := strconv.ParseUint(string(digits), 16, 32)
+	if err != nil || value > unicode.MaxRune || !utf8.ValidRune(rune(value)) {
+		return 0, 0, fmt.Errorf("invalid code point \\x{%s}", string(digits))
+	}
+	return rune(value), width, nil
+}
+
+// readQuotedSpan reads the text of a \Q...\E span from the start of pattern,
+// which begins just after the \Q. Without a closing \E the span runs to the
+// end of the pattern. It returns the quoted runes and the number of runes
+// consumed, the \E included.
+func readQuotedSpan(pattern []rune) ([]rune, int) {
+	for i := 0; i+1 < len(pattern); i++ {
+		if pattern[i] == '\\' && pattern[i+1] == 'E' {
+			return pattern[:i], i + 2
+		}
+	}
+	return pattern, len(pattern)
+}
+
+// readBracketTerm reads a POSIX class [:name:], an equivalence class [=x=]
+// or a collating element [.x.] from the start of pattern. Without locale
+// collation data, equivalence classes and collating elements are limited to
+// a single character and stand for that character.
+func readBracketTerm(pattern []rune) (setMember, int, error) {
+	delimiter := pattern[1]
+
+	nameLength := -1
+	for i := 2; i+1 < len(pattern); i++ {
+		if pattern[i] == delimiter && pattern[i+1] == ']' {
+			nameLength = i - 2
+			break
+		}
+	}
+	if nameLength == -1 {
+		return setMember{}, 0, fmt.Errorf("unterminated [%c in character set", delimiter)
+	}
+	name := pattern[2 : 2+nameLength]
+	width := nameLength + 4
+
+	if delimiter == ':' {
+		class, ok := posixClasses[string(name)]
+		if !ok {
+			return setMember{}, 0, fmt.Errorf("invalid character class name [:%s:]", string(name))
+		}
+		return setMember{class: class, isClass: true}, width, nil
+	}
+
+	if len(name) != 1 {
+		return setMember{}, 0, fmt.Errorf("unsupported collating element [%c%s%c]", delimiter, string(name), delimiter)
+	}
+	return setMember{literal: name[0]}, width, nil
+}
+
+// readUnicodeProperty reads a property escape from the start of pattern,
+// which begins at the 'p' or 'P' following the backslash. It accepts both
+// the braced form \p{Greek} and the one-letter form \pL, and returns the
+// number of runes consumed.
+func readUnicodeProperty(pattern []rune) (predefinedclass.UnicodeProperty, int, error) {
+	property := predefinedclass.UnicodeProperty{Negated: pattern[0] == 'P'}
+	if len(pattern) < 2 {
+		return property, 0, fmt.Errorf("missing property name after \\%c", pattern[0])
+	}
+
+	width := 2
+	if pattern[1] == '{' {
+		closingIndex := slices.Index(pattern, '}')
+		if closingIndex == -1 {
+			return property, 0, fmt.Errorf("unterminated \\%c{", pattern[0])
+		}
+		property.Name = string(pattern[2:closingIndex])
+		width = closingIndex + 1
+	} else {
+		property.Name = string(pattern[1])
+	}
+
+	if _, ok := predefinedclass.LookupUnicodeProperty(property.Name); !ok {
+		return property, 0, fmt.Errorf("unknown Unicode property %q", property.Name)
+	}
+	return property, width, nil
+}
+
+// tokenizeGroupOpener parses a group opener at the start of pattern, which
+// must begin with '('. Besides the plain capturing '(', it understands the
+// non-capturing (?:, the atomic (?>, the lookaround (?=, (?!, (?<= and (?<!
+// and the named (?P<name> and (?<name> forms, as well as inline flags and
+// conditionals. It returns the token and the number of runes it spans.
+func tokenizeGroupOpener(pattern []rune) (token.Token, int, error) {
+	if len(pattern) < 2 || pattern[1] != '?' {
+		return &token.GroupingOpener{}, 1, nil
+	}
+	if len(pattern) < 3 {
+		return nil, 0, fmt.Errorf("missing group type after (?")
+	}
+
+	switch {
+	case pattern[2] == ':':
+		return &token.GroupingOpener{Kind: token.GroupNonCapturing}, 3, nil
+	case pattern[2] == '>':
+		return &token.GroupingOpener{Kind: token.GroupAtomic}, 3, nil
+	case pattern[2] == '=':
+		return &token.GroupingOpener{Kind: token.GroupLookahead}, 3, nil
+	case pattern[2] == '!':
+		return &token.GroupingOpener{Kind: token.GroupNegativeLookahead}, 3, nil
+	case pattern[2] == '<' && len(pattern) > 3 && pattern[3] == '=':
+		return &token.GroupingOpener{Kind: token.GroupLookbehind}, 4, nil
+	case pattern[2] == '<' && len(pattern) > 3 && pattern[3] == '!':
+		return &token.GroupingOpener{Kind: token.GroupNegativeLookbehind}, 4, nil
+	case pattern[2] == '<':
+		name, width, err := readGroupName(pattern[2:], "(?")
+		if err != nil {
+			return nil, 0, err
+		}
+		return &token.GroupingOpener{Name: name}, width + 2, nil
+	case pattern[2] == 'R', isDigit(pattern[2]), pattern[2] == '&',
+		pattern[2] == 'P' && len(pattern) > 3 && pattern[3] == '>':
+		return tokenizeSubroutineCall(pattern)
+	case pattern[2] == 'P' && len(pattern) > 3 && pattern[3] == '<':
+		name, width, err := readGroupName(pattern[3:], "(?P")
+		if err != nil {
+			return nil, 0, err
+		}
+		return &token.GroupingOpener{Name: name}, width + 3, nil
+	case pattern[2] == '(':
+		return tokenizeConditionalOpener(pattern)
+	case pattern[2] == '-' || isInlineFlag(pattern[2]):
+		return tokenizeInlineFlags(pattern)
+	default:
+		return nil, 0, fmt.Errorf("unsupported group syntax (?%c", pattern[2])
+	}
+}
+
+// tokenizeConditionalOpener parses the opener of a conditional group at the
+// start of pattern, which must begin with "(?(". The condition names a group
+// by number, as in (?(1), or by name, as in (?(<name>), (?('name') or
+// (?(name).
+func tokenizeConditionalOpener(pattern []rune) (token.Token, int, error) {
+	closingIndex := slices.Index(pattern[3:], ')')
+	if closingIndex == -1 {
+		return nil, 0, fmt.Errorf("unterminated condition after (?(")
+	}
+	condition := pattern[3 : 3+closingIndex]
+	width := closingIndex + 4
+	invalid := fmt.Errorf("invalid condition (?(%s)", string(condition))
+
+	opener := &token.GroupingOpener{Kind: token.GroupConditional}
+	if len(condition) > 0 && !slices.ContainsFunc(condition, func(r rune) bool { return !isDigit(r) }) {
+		index, err := strconv.Atoi(string(condition))
+		if err != nil || index == 0 {
+			return nil, 0, invalid
+		}
+		opener.ConditionIndex = index
+		return opener, width, nil
+	}
+
+	name := condition
+	if len(name) >= 2 {
+		first, last := name[0], name[len(name)-1]
+		if (first == '<' && last == '>') || (first == '\'' && last == '\'') {
+			name = name[1 : len(name)-1]
+		}
+	}
+	if !isValidGroupName(name) {
+		return nil, 0, invalid
+	}
+	opener.ConditionName = string(name)
+	return opener, width, nil
+}
+
+// tokenizeSubroutineCall parses a subroutine call at the start of pattern,
+// which must begin with "(?". (?R) and (?0) recurse into the whole pattern,
+// (?N) calls the group numbered N, and (?&name) and (?P>name) call a named
+// group.
+func tokenizeSubroutineCall(pattern []rune) (token.Token, int, error) {
+	bodyStart := 2
+	switch pattern[2] {
+	case '&':
+		bodyStart = 3
+	case 'P':
+		bodyStart = 4
+	}
+	closingIndex := slices.Index(pattern[bodyStart:], ')')
+	if closingIndex == -1 {
+		return nil, 0, fmt.Errorf("unterminated subroutine call (?%s", string(pattern[2:bodyStart]))
+	}
+	body := pattern[bodyStart : bodyStart+closingIndex]
+	width := bodyStart + closingIndex + 1
+	invalid := fmt.Errorf("invalid subroutine call (?%s)", string(pattern[2:bodyStart+closingIndex]))
+
+	if bodyStart > 2 {
+		if !isValidGroupName(body) {
+			return nil, 0, invalid
+		}
+		return &token.SubroutineCall{Name: string(body)}, width, nil
+	}
+	if string(body) == "R" {
+		return &token.SubroutineCall{GroupIndex: 0}, width, nil
+	}
+	if len(body) == 0 || slices.ContainsFunc(body, func(r rune) bool { return !isDigit(r) }) {
+		return nil, 0, invalid
+	}
+	groupIndex, err := strconv.Atoi(string(body))
+	if err != nil {
+		return nil, 0, invalid
+	}
+	return &token.SubroutineCall{GroupIndex: groupIndex}, width, nil
+}
+
+func isInlineFlag(r rune) bool {
+	_, ok := inlineflag.FromLetter(r)
+	return ok
+}
+
+// tokenizeInlineFlags parses a (?flags) modifier or the opener of a
+// (?flags:...) group at the start of pattern, which must begin with "(?".
+// Flags after a '-' are switched off. It returns the token and the number of
+// runes it spans.
+func tokenizeInlineFlags(pattern []rune) (token.Token, int, error) {
+	var on, off inlineflag.Flags
+	negated := false
+	for index := 2; index < len(pattern); index++ {
+		switch r := pattern[index]; r {
+		case '-':
+			if negated {
+				return nil, 0, fmt.Errorf("invalid inline flags: repeated -")
+			}
+			negated = true
+		case ')':
+			return &token.InlineFlags{On: on, Off: off}, index + 1, nil
+		case ':':
+			opener := &token.GroupingOpener{
+				Kind:     token.GroupNonCapturing,
+				FlagsOn:  on,
+				FlagsOff: off,
+			}
+			return opener, index + 1, nil
+		default:
+			flag, ok := inlineflag.FromLetter(r)
+			if !ok {
+				return nil, 0, fmt.Errorf("unsupported inline flag %c", r)
+			}
+			if negated {
+				off |= flag
+			} else {
+				on |= flag
+			}
+		}
+	}
+	return nil, 0, fmt.Errorf("missing ) after inline flags")
+}
+
+// readGroupReference reads a \g{N}, \g{-N} or \g{name} reference from the
+// start of pattern, which begins at the 'g'. For \g{-N} it reports relative
+// and leaves N in CaptureIndex. It also returns the number of runes the
+// reference spans, the 'g' included.
+func readGroupReference(pattern []rune) (*token.BackReference, bool, int, error) {
+	if len(pattern) < 2 || pattern[1] != '{' {
+		return nil, false, 0, fmt.Errorf("missing { after \\g")
+	}
+	closingIndex := slices.Index(pattern, '}')
+	if closingIndex == -1 {
+		return nil, false, 0, fmt.Errorf("unterminated \\g{")
+	}
+	body := pattern[2:closingIndex]
+	width := closingIndex + 1
+
+	if isValidGroupName(body) {
+		return &token.BackReference{Name: string(body)}, false, width, nil
+	}
+
+	relative := len(body) > 0 && body[0] == '-'
+	digits := body
+	if relative {
+		digits = body[1:]
+	}
+	invalid := fmt.Errorf("invalid group reference \\g{%s}", string(body))
+	if len(digits) == 0 || slices.ContainsFunc(digits, func(r rune) bool { return !isDigit(r) }) {
+		return nil, false, 0, invalid
+	}
+	captureIndex, err := strconv.Atoi(string(digits))
+	if err != nil || captureIndex == 0 {
+		return nil, false, 0, invalid
+	}
+	return &token.BackReference{CaptureIndex: captureIndex}, relative, width, nil
+}
+
+// readGroupName reads a <name> from the start of pattern and returns the name
+// and the number of runes it spans, brackets included. The prefix is only
+// used to describe the construct in error messages.
+func readGroupName(pattern []rune, prefix string) (string, int, error) {
+	if len(pattern) == 0 || pattern[0] != '<' {
+		return "", 0, fmt.Errorf("missing group name after %s", prefix)
+	}
+	closingIndex := slices.Index(pattern, '>')
+	if closingIndex == -1 {
+		return "", 0, fmt.Errorf("unterminated group name after %s", prefix)
+	}
+
+	name := pattern[1:closingIndex]
+	if !isValidGroupName(name) {
+		return "", 0, fmt.Errorf("invalid group name %q", string(name))
+	}
+	return string(name), closingIndex + 1, nil
+}
+
+// isValidGroupName reports whether name is a letter or underscore followed
+// by letters, digits and underscores.
+func isValidGroupName(name []rune) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i, r := range name {
+		isWordStart := r == '_' || unicode.IsLetter(r)
+		if !isWordStart && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
@@ -5,6 +5,9 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/mmarchesotti/build-your-own-grep/internal/anchor"
+	"github.com/mmarchesotti/build-your-own-grep/internal/boundary"
+	"github.com/mmarchesotti/build-your-own-grep/internal/inlineflag"
 	"github.com/mmarchesotti/build-your-own-grep/internal/predefinedclass"
 	"github.com/mmarchesotti/build-your-own-grep/internal/token"
 )
@@ -25,12 +28,46 @@ func TestTokenize(t *testing.T) {
 				&token.Literal{Literal: 'c'},
 			},
 		},
+		{
+			name:  "multi-byte literals",
+			input: "café",
+			expected: []token.Token{
+				&token.Literal{Literal: 'c'},
+				&token.Literal{Literal: 'a'},
+				&token.Literal{Literal: 'f'},
+				&token.Literal{Literal: 'é'},
+			},
+		},
+		{
+			name:  "escaped multi-byte literal",
+			input: `\ü+`,
+			expected: []token.Token{
+				&token.Literal{Literal: 'ü'},
+				&token.PositiveClosure{},
+			},
+		},
+		{
+			name:  "multi-byte character set and range",
+			input: `[äöüα-ω]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: true,
+					Literals:   []rune{'ä', 'ö', 'ü'},
+					Ranges:     [][2]rune{{'α', 'ω'}},
+				},
+			},
+		},
+		{
+			name:     "invalid UTF-8",
+			input:    "ab\xffc",
+			expected: nil,
+			err:      fmt.Errorf("invalid UTF-8 in pattern at byte 2"),
+		},
 		{
 			name:  "all metacharacters",
 			input: `*+?|^$.`,
 			expected: []token.Token{
-				&token.KleeneClosure{},
-				&token.PositiveClosure{},
+				&token.KleeneClosure{Possessive: true},
 				&token.OptionalQuantifier{},
 				&token.Alternation{},
 				&token.StartAnchor{},
@@ -38,6 +75,73 @@ func TestTokenize(t *testing.T) {
 				&token.Wildcard{},
 			},
 		},
+		{
+			name:  "lazy quantifiers",
+			input: `a*?b+?c??d{2,}?`,
+			expected: []token.Token{
+				&token.Literal{Literal: 'a'},
+				&token.KleeneClosure{Lazy: true},
+				&token.Literal{Literal: 'b'},
+				&token.PositiveClosure{Lazy: true},
+				&token.Literal{Literal: 'c'},
+				&token.OptionalQuantifier{Lazy: true},
+				&token.Literal{Literal: 'd'},
+				&token.RepetitionQuantifier{Min: 2, Max: -1, Lazy: true},
+			},
+		},
+		{
+			name:  "possessive quantifiers",
+			input: `a*+b++c?+d{1,2}+`,
+			expected: []token.Token{
+				&token.Literal{Literal: 'a'},
+				&token.KleeneClosure{Possessive: true},
+				&token.Literal{Literal: 'b'},
+				&token.PositiveClosure{Possessive: true},
+				&token.Literal{Literal: 'c'},
+				&token.OptionalQuantifier{Possessive: true},
+				&token.Literal{Literal: 'd'},
+				&token.RepetitionQuantifier{Min: 1, Max: 2, Possessive: true},
+			},
+		},
+		{
+			name:  "atomic group",
+			input: `(?>ab)`,
+			expected: []token.Token{
+				&token.GroupingOpener{Kind: token.GroupAtomic},
+				&token.Literal{Literal: 'a'},
+				&token.Literal{Literal: 'b'},
+				&token.GroupingCloser{},
+			},
+		},
+		{
+			name:  "lookaround groups",
+			input: `(?=a)(?!b)(?<=c)(?<!d)`,
+			expected: []token.Token{
+				&token.GroupingOpener{Kind: token.GroupLookahead},
+				&token.Literal{Literal: 'a'},
+				&token.GroupingCloser{},
+				&token.GroupingOpener{Kind: token.GroupNegativeLookahead},
+				&token.Literal{Literal: 'b'},
+				&token.GroupingCloser{},
+				&token.GroupingOpener{Kind: token.GroupLookbehind},
+				&token.Literal{Literal: 'c'},
+				&token.GroupingCloser{},
+				&token.GroupingOpener{Kind: token.GroupNegativeLookbehind},
+				&token.Literal{Literal: 'd'},
+				&token.GroupingCloser{},
+			},
+		},
+		{
+			name:  "word boundaries",
+			input: `\ba\B\<\>`,
+			expected: []token.Token{
+				&token.WordBoundary{Kind: boundary.WordBoundary},
+				&token.Literal{Literal: 'a'},
+				&token.WordBoundary{Kind: boundary.NonWordBoundary},
+				&token.WordBoundary{Kind: boundary.WordStart},
+				&token.WordBoundary{Kind: boundary.WordEnd},
+			},
+		},
 		{
 			name:  "escaped metacharacter",
 			input: `\+`,
@@ -78,7 +182,323 @@ func TestTokenize(t *testing.T) {
 				&token.BackReference{CaptureIndex: 9},
 			},
 		},
+		{
+			name:  "braced and relative backreferences",
+			input: `(a)(b)\g{1}\g{-1}\g{-2}`,
+			expected: []token.Token{
+				&token.GroupingOpener{},
+				&token.Literal{Literal: 'a'},
+				&token.GroupingCloser{},
+				&token.GroupingOpener{},
+				&token.Literal{Literal: 'b'},
+				&token.GroupingCloser{},
+				&token.BackReference{CaptureIndex: 1},
+				&token.BackReference{CaptureIndex: 2},
+				&token.BackReference{CaptureIndex: 1},
+			},
+		},
+		{
+			name:  "relative backreference counts groups opened so far",
+			input: `(a)\g{-1}(b)`,
+			expected: []token.Token{
+				&token.GroupingOpener{},
+				&token.Literal{Literal: 'a'},
+				&token.GroupingCloser{},
+				&token.BackReference{CaptureIndex: 1},
+				&token.GroupingOpener{},
+				&token.Literal{Literal: 'b'},
+				&token.GroupingCloser{},
+			},
+		},
+		{
+			name:  "braced named backreference",
+			input: `\g{word}`,
+			expected: []token.Token{
+				&token.BackReference{Name: "word"},
+			},
+		},
+		{
+			name:  "multi-digit backreference without that many groups",
+			input: `(a)\12`,
+			expected: []token.Token{
+				&token.GroupingOpener{},
+				&token.Literal{Literal: 'a'},
+				&token.GroupingCloser{},
+				&token.BackReference{CaptureIndex: 12},
+			},
+		},
+		{
+			name:     "relative backreference before the first group",
+			input:    `(a)\g{-2}`,
+			expected: nil,
+			err:      fmt.Errorf(`relative reference \g{-2} points before the first group`),
+		},
+		{
+			name:     "invalid braced backreference",
+			input:    `\g{0}`,
+			expected: nil,
+			err:      fmt.Errorf(`invalid group reference \g{0}`),
+		},
+		{
+			name:     "unbraced \\g",
+			input:    `\g1`,
+			expected: nil,
+			err:      fmt.Errorf(`missing { after \g`),
+		},
 		// -------------------------------
+		{
+			name:  "non-capturing group",
+			input: `(?:ab)`,
+			expected: []token.Token{
+				&token.GroupingOpener{Kind: token.GroupNonCapturing},
+				&token.Literal{Literal: 'a'},
+				&token.Literal{Literal: 'b'},
+				&token.GroupingCloser{},
+			},
+		},
+		{
+			name:  "named groups and named backreference",
+			input: `(?P<first>a)(?<second>b)\k<first>`,
+			expected: []token.Token{
+				&token.GroupingOpener{Name: "first"},
+				&token.Literal{Literal: 'a'},
+				&token.GroupingCloser{},
+				&token.GroupingOpener{Name: "second"},
+				&token.Literal{Literal: 'b'},
+				&token.GroupingCloser{},
+				&token.BackReference{Name: "first"},
+			},
+		},
+		{
+			name:     "invalid group name",
+			input:    `(?<1st>a)`,
+			expected: nil,
+			err:      fmt.Errorf(`invalid group name "1st"`),
+		},
+		{
+			name:     "unterminated group name",
+			input:    `(?P<name`,
+			expected: nil,
+			err:      fmt.Errorf("unterminated group name after (?P"),
+		},
+		{
+			name:     "named backreference without name",
+			input:    `\k1`,
+			expected: nil,
+			err:      fmt.Errorf(`missing group name after \k`),
+		},
+		{
+			name:  "inline flags",
+			input: `(?i)a(?m-s:b)`,
+			expected: []token.Token{
+				&token.InlineFlags{On: inlineflag.CaseInsensitive},
+				&token.Literal{Literal: 'a'},
+				&token.GroupingOpener{
+					Kind:     token.GroupNonCapturing,
+					FlagsOn:  inlineflag.Multiline,
+					FlagsOff: inlineflag.DotAll,
+				},
+				&token.Literal{Literal: 'b'},
+				&token.GroupingCloser{},
+			},
+		},
+		{
+			name:  "extended mode skips whitespace and comments",
+			input: "(?x) a b # comment\n[ ]\\ (?-x: )",
+			expected: []token.Token{
+				&token.InlineFlags{On: inlineflag.Extended},
+				&token.Literal{Literal: 'a'},
+				&token.Literal{Literal: 'b'},
+				&token.CharacterSet{IsPositive: true, Literals: []rune{' '}},
+				&token.Literal{Literal: ' '},
+				&token.GroupingOpener{Kind: token.GroupNonCapturing, FlagsOff: inlineflag.Extended},
+				&token.Literal{Literal: ' '},
+				&token.GroupingCloser{},
+			},
+		},
+		{
+			name:  "extended mode ends with its group",
+			input: "((?x) a) b",
+			expected: []token.Token{
+				&token.GroupingOpener{},
+				&token.InlineFlags{On: inlineflag.Extended},
+				&token.Literal{Literal: 'a'},
+				&token.GroupingCloser{},
+				&token.Literal{Literal: ' '},
+				&token.Literal{Literal: 'b'},
+			},
+		},
+		{
+			name:  "inline comment ends at the first closer",
+			input: `a(?#skip (this)*b`,
+			expected: []token.Token{
+				&token.Literal{Literal: 'a'},
+				&token.KleeneClosure{},
+				&token.Literal{Literal: 'b'},
+			},
+		},
+		{
+			name:     "unterminated inline comment",
+			input:    `a(?#b`,
+			expected: nil,
+			err:      fmt.Errorf("missing ) after comment"),
+		},
+		{
+			name:  "absolute anchors",
+			input: `\Aa\z\Z`,
+			expected: []token.Token{
+				&token.Anchor{Kind: anchor.TextStart},
+				&token.Literal{Literal: 'a'},
+				&token.Anchor{Kind: anchor.TextEnd},
+				&token.Anchor{Kind: anchor.TextEndBeforeNewline},
+			},
+		},
+		{
+			name:  "control escapes",
+			input: `\t\n\r\f\v\a\e`,
+			expected: []token.Token{
+				&token.Literal{Literal: '\t'},
+				&token.Literal{Literal: '\n'},
+				&token.Literal{Literal: '\r'},
+				&token.Literal{Literal: '\f'},
+				&token.Literal{Literal: '\v'},
+				&token.Literal{Literal: '\a'},
+				&token.Literal{Literal: 0x1b},
+			},
+		},
+		{
+			name:  "hexadecimal and octal escapes",
+			input: `\x41\xa\x{1F600}\0\012\0778`,
+			expected: []token.Token{
+				&token.Literal{Literal: 'A'},
+				&token.Literal{Literal: '\n'},
+				&token.Literal{Literal: '😀'},
+				&token.Literal{Literal: 0},
+				&token.Literal{Literal: '\n'},
+				&token.Literal{Literal: '?'},
+				&token.Literal{Literal: '8'},
+			},
+		},
+		{
+			name:  "quoted span",
+			input: `\Qa.*\E+b\Q(`,
+			expected: []token.Token{
+				&token.Literal{Literal: 'a'},
+				&token.Literal{Literal: '.'},
+				&token.Literal{Literal: '*'},
+				&token.PositiveClosure{},
+				&token.Literal{Literal: 'b'},
+				&token.Literal{Literal: '('},
+			},
+		},
+		{
+			name:  "escapes inside a character set",
+			input: `[\t\x41-\x{43}\b\Q]^\E]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: true,
+					Literals:   []rune{'\t', '\b', ']', '^'},
+					Ranges:     [][2]rune{{'A', 'C'}},
+				},
+			},
+		},
+		{
+			name:     "unknown letter escape",
+			input:    `a\yb`,
+			expected: nil,
+			err:      fmt.Errorf(`unknown escape sequence \y`),
+		},
+		{
+			name:     "unknown letter escape inside a character set",
+			input:    `[\q]`,
+			expected: nil,
+			err:      fmt.Errorf(`unknown escape sequence \q`),
+		},
+		{
+			name:     "code point out of range",
+			input:    `\x{110000}`,
+			expected: nil,
+			err:      fmt.Errorf(`invalid code point \x{110000}`),
+		},
+		{
+			name:     "hexadecimal escape without digits",
+			input:    `\xg`,
+			expected: nil,
+			err:      fmt.Errorf(`missing hexadecimal digits after \x`),
+		},
+		{
+			name:     "unsupported inline flag",
+			input:    `(?iq)a`,
+			expected: nil,
+			err:      fmt.Errorf("unsupported inline flag q"),
+		},
+		{
+			name:     "unterminated inline flags",
+			input:    `(?i`,
+			expected: nil,
+			err:      fmt.Errorf("missing ) after inline flags"),
+		},
+		{
+			name:  "conditional groups",
+			input: `(?(1)a|b)(?(<q>)c)(?('q')d)(?(q)e)`,
+			expected: []token.Token{
+				&token.GroupingOpener{Kind: token.GroupConditional, ConditionIndex: 1},
+				&token.Literal{Literal: 'a'},
+				&token.Alternation{},
+				&token.Literal{Literal: 'b'},
+				&token.GroupingCloser{},
+				&token.GroupingOpener{Kind: token.GroupConditional, ConditionName: "q"},
+				&token.Literal{Literal: 'c'},
+				&token.GroupingCloser{},
+				&token.GroupingOpener{Kind: token.GroupConditional, ConditionName: "q"},
+				&token.Literal{Literal: 'd'},
+				&token.GroupingCloser{},
+				&token.GroupingOpener{Kind: token.GroupConditional, ConditionName: "q"},
+				&token.Literal{Literal: 'e'},
+				&token.GroupingCloser{},
+			},
+		},
+		{
+			name:     "invalid condition",
+			input:    `(?(1a)b)`,
+			expected: nil,
+			err:      fmt.Errorf("invalid condition (?(1a)"),
+		},
+		{
+			name:     "unterminated condition",
+			input:    `(?(1`,
+			expected: nil,
+			err:      fmt.Errorf("unterminated condition after (?("),
+		},
+		{
+			name:  "subroutine calls",
+			input: `(?R)(?0)(?12)(?&name)(?P>name)`,
+			expected: []token.Token{
+				&token.SubroutineCall{GroupIndex: 0},
+				&token.SubroutineCall{GroupIndex: 0},
+				&token.SubroutineCall{GroupIndex: 12},
+				&token.SubroutineCall{Name: "name"},
+				&token.SubroutineCall{Name: "name"},
+			},
+		},
+		{
+			name:     "invalid subroutine call",
+			input:    `(?1a)`,
+			expected: nil,
+			err:      fmt.Errorf("invalid subroutine call (?1a)"),
+		},
+		{
+			name:     "unterminated subroutine call",
+			input:    `(?&name`,
+			expected: nil,
+			err:      fmt.Errorf("unterminated subroutine call (?&"),
+		},
+		{
+			name:     "unsupported group syntax",
+			input:    `(?~a)`,
+			expected: nil,
+			err:      fmt.Errorf("unsupported group syntax (?~"),
+		},
 		{
 			name:  "escaped predefined classes",
 			input: `\d\w`,
@@ -87,6 +507,64 @@ func TestTokenize(t *testing.T) {
 				&token.AlphaNumeric{},
 			},
 		},
+		{
+			name:  "whitespace and negated classes",
+			input: `\s\D\W\S`,
+			expected: []token.Token{
+				&token.Whitespace{},
+				&token.NonDigit{},
+				&token.NonAlphaNumeric{},
+				&token.NonWhitespace{},
+			},
+		},
+		{
+			name:  "character set with whitespace class",
+			input: `[\s,;]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: true,
+					Literals:   []rune{',', ';'},
+					CharacterClasses: []predefinedclass.PredefinedClass{
+						predefinedclass.ClassWhitespace,
+					},
+				},
+			},
+		},
+		{
+			name:  "unicode property classes",
+			input: `\p{Lu}\P{Greek}\pL`,
+			expected: []token.Token{
+				&token.UnicodeClass{Name: "Lu"},
+				&token.UnicodeClass{Name: "Greek", Negated: true},
+				&token.UnicodeClass{Name: "L"},
+			},
+		},
+		{
+			name:  "unicode property inside character set",
+			input: `[\p{Han}\P{L}_]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: true,
+					Literals:   []rune{'_'},
+					UnicodeProperties: []predefinedclass.UnicodeProperty{
+						{Name: "Han"},
+						{Name: "L", Negated: true},
+					},
+				},
+			},
+		},
+		{
+			name:     "unknown unicode property",
+			input:    `\p{Klingon}`,
+			expected: nil,
+			err:      fmt.Errorf(`unknown Unicode property "Klingon"`),
+		},
+		{
+			name:     "unterminated unicode property",
+			input:    `\p{Greek`,
+			expected: nil,
+			err:      fmt.Errorf(`unterminated \p{`),
+		},
 		{
 			name:  "simple character set",
 			input: "[abc]",
@@ -121,14 +599,210 @@ func TestTokenize(t *testing.T) {
 			},
 		},
 		{
-			name:  "empty character set",
-			input: `[]`,
+			name:     "closing bracket first is a literal member",
+			input:    `[]`,
+			expected: nil,
+			err:      fmt.Errorf("unmatched character set opener ["),
+		},
+		{
+			name:  "character set with ranges",
+			input: `[a-z0-9_]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: true,
+					Literals:   []rune{'_'},
+					Ranges:     [][2]rune{{'a', 'z'}, {'0', '9'}},
+				},
+			},
+		},
+		{
+			name:  "character set intersection with nested set",
+			input: `[a-z&&[^aeiou]]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: true,
+					Ranges:     [][2]rune{{'a', 'z'}},
+					Intersect: []*token.CharacterSet{
+						{IsPositive: false, Literals: []rune{'a', 'e', 'i', 'o', 'u'}},
+					},
+				},
+			},
+		},
+		{
+			name:  "character set subtraction of members",
+			input: `[\w--\d_]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive:       true,
+					CharacterClasses: []predefinedclass.PredefinedClass{predefinedclass.ClassAlphanumeric},
+					Subtract: []*token.CharacterSet{
+						{
+							IsPositive:       true,
+							Literals:         []rune{'_'},
+							CharacterClasses: []predefinedclass.PredefinedClass{predefinedclass.ClassDigit},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:  "set operators before the closer are members",
+			input: `[a&&][!--]`,
+			expected: []token.Token{
+				&token.CharacterSet{IsPositive: true, Literals: []rune{'a', '&', '&'}},
+				&token.CharacterSet{IsPositive: true, Ranges: [][2]rune{{'!', '-'}}},
+			},
+		},
+		{
+			name:     "set operator without a left operand",
+			input:    `[a&&--b]`,
+			expected: nil,
+			err:      fmt.Errorf("missing operand before -- in character set"),
+		},
+		{
+			name:     "members after a nested operand",
+			input:    `[a-z--[x]y]`,
+			expected: nil,
+			err:      fmt.Errorf("expected ] or set operator after nested character set"),
+		},
+		{
+			name:  "negated character set with range",
+			input: `[^A-F]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: false,
+					Ranges:     [][2]rune{{'A', 'F'}},
+				},
+			},
+		},
+		{
+			name:  "literal dash at either end",
+			input: `[-a-c-]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: true,
+					Literals:   []rune{'-', '-'},
+					Ranges:     [][2]rune{{'a', 'c'}},
+				},
+			},
+		},
+		{
+			name:  "closing bracket as first member",
+			input: `[]a]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: true,
+					Literals:   []rune{']', 'a'},
+				},
+			},
+		},
+		{
+			name:  "closing bracket as first member of negated set",
+			input: `[^]a]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: false,
+					Literals:   []rune{']', 'a'},
+				},
+			},
+		},
+		{
+			name:  "escaped closing bracket",
+			input: `[a\]b]`,
 			expected: []token.Token{
 				&token.CharacterSet{
 					IsPositive: true,
+					Literals:   []rune{'a', ']', 'b'},
 				},
 			},
 		},
+		{
+			name:  "range ending in escaped character",
+			input: `[!-\]]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: true,
+					Ranges:     [][2]rune{{'!', ']'}},
+				},
+			},
+		},
+		{
+			name:  "posix classes",
+			input: `[[:alpha:][:digit:]_]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: true,
+					Literals:   []rune{'_'},
+					CharacterClasses: []predefinedclass.PredefinedClass{
+						predefinedclass.ClassAlpha,
+						predefinedclass.ClassDigit,
+					},
+				},
+			},
+		},
+		{
+			name:  "negated posix class",
+			input: `[^[:space:]]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: false,
+					CharacterClasses: []predefinedclass.PredefinedClass{
+						predefinedclass.ClassWhitespace,
+					},
+				},
+			},
+		},
+		{
+			name:  "equivalence class and collating elements",
+			input: `[[=e=][.-.]-[.0.]]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: true,
+					Literals:   []rune{'e'},
+					Ranges:     [][2]rune{{'-', '0'}},
+				},
+			},
+		},
+		{
+			name:  "opening bracket as a plain member",
+			input: `[[a]`,
+			expected: []token.Token{
+				&token.CharacterSet{
+					IsPositive: true,
+					Literals:   []rune{'[', 'a'},
+				},
+			},
+		},
+		{
+			name:     "unknown posix class",
+			input:    `[[:letter:]]`,
+			expected: nil,
+			err:      fmt.Errorf("invalid character class name [:letter:]"),
+		},
+		{
+			name:     "unterminated posix class",
+			input:    `[[:alpha]`,
+			expected: nil,
+			err:      fmt.Errorf("unterminated [: in character set"),
+		},
+		{
+			name:     "multi-character collating element",
+			input:    `[[.ch.]]`,
+			expected: nil,
+			err:      fmt.Errorf("unsupported collating element [.ch.]"),
+		},
+		{
+			name:     "reversed range",
+			input:    `[z-a]`,
+			expected: nil,
+			err:      fmt.Errorf("invalid character range z-a"),
+		},
+		{
+			name:     "class as range endpoint",
+			input:    `[a-\d]`,
+			expected: nil,
+			err:      fmt.Errorf("invalid character range: class used as range endpoint"),
+		},
 		{
 			name:  "literal and character set concatenation",
 			input: `a[bc]`,
@@ -154,6 +828,71 @@ func TestTokenize(t *testing.T) {
 				&token.Literal{Literal: 'd'},
 			},
 		},
+		{
+			name:  "exact repetition",
+			input: `a{3}`,
+			expected: []token.Token{
+				&token.Literal{Literal: 'a'},
+				&token.RepetitionQuantifier{Min: 3, Max: 3},
+			},
+		},
+		{
+			name:  "open-ended repetition",
+			input: `a{2,}`,
+			expected: []token.Token{
+				&token.Literal{Literal: 'a'},
+				&token.RepetitionQuantifier{Min: 2, Max: -1},
+			},
+		},
+		{
+			name:  "bounded repetition",
+			input: `a{2,5}`,
+			expected: []token.Token{
+				&token.Literal{Literal: 'a'},
+				&token.RepetitionQuantifier{Min: 2, Max: 5},
+			},
+		},
+		{
+			name:  "repetition without lower bound",
+			input: `a{,5}`,
+			expected: []token.Token{
+				&token.Literal{Literal: 'a'},
+				&token.RepetitionQuantifier{Min: 0, Max: 5},
+			},
+		},
+		{
+			name:  "brace that does not open a repetition",
+			input: `{a}`,
+			expected: []token.Token{
+				&token.Literal{Literal: '{'},
+				&token.Literal{Literal: 'a'},
+				&token.Literal{Literal: '}'},
+			},
+		},
+		{
+			name:     "reversed repetition bounds",
+			input:    `a{3,1}`,
+			expected: nil,
+			err:      fmt.Errorf("invalid repetition {3,1}: minimum greater than maximum"),
+		},
+		{
+			name:     "malformed repetition bound",
+			input:    `a{1x}`,
+			expected: nil,
+			err:      fmt.Errorf("invalid repetition {1x}"),
+		},
+		{
+			name:     "unterminated repetition",
+			input:    `a{2`,
+			expected: nil,
+			err:      fmt.Errorf("unmatched repetition opener {"),
+		},
+		{
+			name:     "repetition bound too large",
+			input:    `a{1001}`,
+			expected: nil,
+			err:      fmt.Errorf("invalid repetition {1001}: bound exceeds 1000"),
+		},
 		{
 			name:     "unmatched opening bracket",
 			input:    `[abc`,
@@ -189,3 +928,118 @@ func TestTokenize(t *testing.T) {
 		})
 	}
 }
+
+func TestTokenizeBasic(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		extended string
+		err      error
+	}{
+		{
+			name:     "escaped operators",
+			input:    `\(ab\)\{2,3\}\|c\+d\?`,
+			extended: `(ab){2,3}|c+d?`,
+		},
+		{
+			name:     "bare operators are literals",
+			input:    `a(b)+?{1}|c`,
+			extended: `a\(b\)\+\?\{1\}\|c`,
+		},
+		{
+			name:     "leading star is literal",
+			input:    `*a\(*b\|*c\)^*d`,
+			extended: `\*a(\*b|\*c)\^*d`,
+		},
+		{
+			name:     "anchors only at the ends",
+			input:    `^a^b$c$`,
+			extended: `^a\^b\$c$`,
+		},
+		{
+			name:     "anchors at the ends of groups and alternatives",
+			input:    `\(^a$\)\|^b$`,
+			extended: `(^a$)|^b$`,
+		},
+		{
+			name:     "bracket expressions and other escapes are unchanged",
+			input:    `[(+?]\d\(x\)\1\Q(\E`,
+			extended: `[(+?]\d(x)\1\Q(\E`,
+		},
+		{
+			name:     "no set operators in bracket expressions",
+			input:    `[+--/][a&&&]`,
+			extended: `[+-\-/][a\&\&\&]`,
+		},
+		{
+			name:     "braces of property escapes are not intervals",
+			input:    `\p{L}\P{Greek}\pN`,
+			extended: `\p{L}\P{Greek}\pN`,
+		},
+		{
+			name:     "braces of hex escapes are not intervals",
+			input:    `\x{41}\x42`,
+			extended: `\x{41}\x42`,
+		},
+		{
+			name:     "braces of group references are not intervals",
+			input:    `\(a\)\g{1}\g{-1}`,
+			extended: `(a)\g{1}\g{-1}`,
+		},
+		{
+			name:     "braced escape followed by an interval",
+			input:    `\p{L}\{2\}`,
+			extended: `\p{L}{2}`,
+		},
+		{
+			name:  "invalid braced escape",
+			input: `\p{Nope}\{2\}`,
+			err:   fmt.Errorf(`unknown Unicode property "Nope"`),
+		},
+		{
+			name:  "unterminated braced escape",
+			input: `\x{41`,
+			err:   fmt.Errorf(`unterminated \x{`),
+		},
+		{
+			name:  "unmatched interval opener",
+			input: `a\{`,
+			err:   fmt.Errorf(`unmatched \{`),
+		},
+		{
+			name:  "interval opener closed only by a literal brace",
+			input: `a\{2}`,
+			err:   fmt.Errorf(`unmatched \{`),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := TokenizeBasic(tt.input, 0)
+			if err != nil && tt.err == nil {
+				t.Fatalf("TokenizeBasic() returned an unexpected error: %v", err)
+			}
+
+			if err == nil && tt.err != nil {
+				t.Fatalf("TokenizeBasic() expected error '%v', but got nil", tt.err)
+			}
+
+			if err != nil && tt.err != nil {
+				if err.Error() != tt.err.Error() {
+					t.Fatalf("TokenizeBasic() expected error '%v', but got '%v'", tt.err, err)
+				}
+				return
+			}
+			expected, err := Tokenize(tt.extended)
+			if err != nil {
+				t.Fatalf("Tokenize() returned an unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("TokenizeBasic() for input '%s' failed", tt.input)
+				t.Errorf("got:  %#v", actual)
+				t.Errorf("want: %#v", expected)
+			}
+		})
+	}
+}
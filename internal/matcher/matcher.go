@@ -4,6 +4,7 @@ package matcher
 import (
 	"fmt"
 	"slices"
+	"unicode"
 )
 
 func isDigit(r rune) bool {
@@ -26,8 +27,53 @@ func isAlphaNumeric(r rune) bool {
 	return isAlpha(r) || isDigit(r) || r == '_'
 }
 
+func isHexDigit(r rune) bool {
+	return isDigit(r) || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
+
+func isControl(r rune) bool {
+	return (r >= 0 && r < ' ') || r == 0x7f
+}
+
+func isGraphic(r rune) bool {
+	return r > ' ' && r < 0x7f
+}
+
+func isPunctuation(r rune) bool {
+	return isGraphic(r) && !isAlpha(r) && !isDigit(r)
+}
+
+func isWhitespace(r rune) bool {
+	switch r {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	default:
+		return false
+	}
+}
+
+// IsWordCharacter reports whether r is a word character as matched by \w,
+// which is what word boundaries are defined against.
+func IsWordCharacter(r rune) bool {
+	return isAlphaNumeric(r)
+}
+
+// EqualFold reports whether a and b are equal under Unicode simple case
+// folding.
+func EqualFold(a rune, b rune) bool {
+	if a == b {
+		return true
+	}
+	for f := unicode.SimpleFold(a); f != a; f = unicode.SimpleFold(f) {
+		if f == b {
+			return true
+		}
+	}
+	return false
+}
+
 func match(r rune, rng [2]rune) (bool, error) {
-	if rng[1] > rng[0] {
+	if rng[0] > rng[1] {
 		return false, fmt.Errorf("range values reversed")
 	}
 	return r >= rng[0] && r <= rng[1], nil
@@ -43,23 +89,91 @@ type PredefinedClassMatcher interface {
 }
 
 type LiteralMatcher struct {
-	Literal rune
+	Literal         rune
+	CaseInsensitive bool
 }
 
 func (l *LiteralMatcher) Match(r rune) (bool, error) {
+	if l.CaseInsensitive {
+		return EqualFold(r, l.Literal), nil
+	}
 	return r == l.Literal, nil
 }
 
+// CharacterSetMatcher matches a bracket expression. The set is built from
+// its members, narrowed to the runes in every set in Intersect and stripped
+// of those in any set in Subtract, as written with && and --. When
+// CaseInsensitive is set, a rune is a member if any of its case variants is.
 type CharacterSetMatcher struct {
 	IsPositive               bool
 	Literals                 []rune
 	Ranges                   [][2]rune
 	CharacterClassesMatchers []PredefinedClassMatcher
+	Intersect                []*CharacterSetMatcher
+	Subtract                 []*CharacterSetMatcher
+	CaseInsensitive          bool
 }
 
 func (p *CharacterSetMatcher) Match(r rune) (bool, error) {
+	m, err := p.inSet(r)
+	if err != nil {
+		return false, err
+	}
+	if p.CaseInsensitive {
+		for f := unicode.SimpleFold(r); f != r && !m; f = unicode.SimpleFold(f) {
+			m, err = p.inSet(f)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return m == p.IsPositive, nil
+}
+
+// includes reports whether an operand matches r, ignoring CaseInsensitive,
+// which only the outermost set uses.
+func (p *CharacterSetMatcher) includes(r rune) (bool, error) {
+	m, err := p.inSet(r)
+	if err != nil {
+		return false, err
+	}
+	return m == p.IsPositive, nil
+}
+
+// inSet reports whether r is one of the members and passes the operands,
+// ignoring IsPositive.
+func (p *CharacterSetMatcher) inSet(r rune) (bool, error) {
+	m, err := p.contains(r)
+	if err != nil {
+		return false, err
+	}
+	for _, operand := range p.Intersect {
+		if !m {
+			break
+		}
+		m, err = operand.includes(r)
+		if err != nil {
+			return false, err
+		}
+	}
+	for _, operand := range p.Subtract {
+		if !m {
+			break
+		}
+		excluded, err := operand.includes(r)
+		if err != nil {
+			return false, err
+		}
+		m = !excluded
+	}
+	return m, nil
+}
+
+// contains reports whether r is one of the members of the set, ignoring
+// IsPositive and the operands.
+func (p *CharacterSetMatcher) contains(r rune) (bool, error) {
 	if slices.Contains(p.Literals, r) {
-		return p.IsPositive, nil
+		return true, nil
 	}
 	for _, rng := range p.Ranges {
 		m, err := match(r, rng)
@@ -67,7 +181,7 @@ func (p *CharacterSetMatcher) Match(r rune) (bool, error) {
 			return false, err
 		}
 		if m {
-			return p.IsPositive, nil
+			return true, nil
 		}
 	}
 	for _, characterClass := range p.CharacterClassesMatchers {
@@ -76,18 +190,27 @@ func (p *CharacterSetMatcher) Match(r rune) (bool, error) {
 			return false, err
 		}
 		if m {
-			return p.IsPositive, nil
+			return true, nil
 		}
 	}
-	return !p.IsPositive, nil
+	return false, nil
 }
 
+// WildcardMatcher is the wildcard outside dot-all mode, which matches any
+// rune but a newline.
 type WildcardMatcher struct{}
 
 func (w *WildcardMatcher) Match(r rune) (bool, error) {
 	return r != '\n', nil
 }
 
+// AnyMatcher is the wildcard in dot-all mode, which also matches a newline.
+type AnyMatcher struct{}
+
+func (a *AnyMatcher) Match(r rune) (bool, error) {
+	return true, nil
+}
+
 type DigitMatcher struct{}
 
 func (d *DigitMatcher) Match(r rune) (bool, error) {
@@ -103,3 +226,121 @@ func (a *AlphaNumericMatcher) Match(r rune) (bool, error) {
 }
 
 func (a *AlphaNumericMatcher) isPredefinedClass() {}
+
+type WhitespaceMatcher struct{}
+
+func (w *WhitespaceMatcher) Match(r rune) (bool, error) {
+	return isWhitespace(r), nil
+}
+
+func (w *WhitespaceMatcher) isPredefinedClass() {}
+
+// NegatedClassMatcher matches every rune its Class does not, as in \D, \W
+// and \S.
+type NegatedClassMatcher struct {
+	Class PredefinedClassMatcher
+}
+
+func (n *NegatedClassMatcher) Match(r rune) (bool, error) {
+	m, err := n.Class.Match(r)
+	if err != nil {
+		return false, err
+	}
+	return !m, nil
+}
+
+func (n *NegatedClassMatcher) isPredefinedClass() {}
+
+// UnicodeClassMatcher matches runes in a Unicode general category or script.
+type UnicodeClassMatcher struct {
+	Table *unicode.RangeTable
+}
+
+func (u *UnicodeClassMatcher) Match(r rune) (bool, error) {
+	return unicode.Is(u.Table, r), nil
+}
+
+func (u *UnicodeClassMatcher) isPredefinedClass() {}
+
+// The matchers below implement the POSIX bracket classes such as [:alpha:].
+// Like \d and \w they follow the C locale and only recognise ASCII.
+
+type AlphaMatcher struct{}
+
+func (a *AlphaMatcher) Match(r rune) (bool, error) {
+	return isAlpha(r), nil
+}
+
+func (a *AlphaMatcher) isPredefinedClass() {}
+
+type AlnumMatcher struct{}
+
+func (a *AlnumMatcher) Match(r rune) (bool, error) {
+	return isAlpha(r) || isDigit(r), nil
+}
+
+func (a *AlnumMatcher) isPredefinedClass() {}
+
+type BlankMatcher struct{}
+
+func (b *BlankMatcher) Match(r rune) (bool, error) {
+	return r == ' ' || r == '\t', nil
+}
+
+func (b *BlankMatcher) isPredefinedClass() {}
+
+type CntrlMatcher struct{}
+
+func (c *CntrlMatcher) Match(r rune) (bool, error) {
+	return isControl(r), nil
+}
+
+func (c *CntrlMatcher) isPredefinedClass() {}
+
+type GraphMatcher struct{}
+
+func (g *GraphMatcher) Match(r rune) (bool, error) {
+	return isGraphic(r), nil
+}
+
+func (g *GraphMatcher) isPredefinedClass() {}
+
+type LowerMatcher struct{}
+
+func (l *LowerMatcher) Match(r rune) (bool, error) {
+	return isLower(r), nil
+}
+
+func (l *LowerMatcher) isPredefinedClass() {}
+
+type PrintMatcher struct{}
+
+func (p *PrintMatcher) Match(r rune) (bool, error) {
+	return r == ' ' || isGraphic(r), nil
+}
+
+func (p *PrintMatcher) isPredefinedClass() {}
+
+type PunctMatcher struct{}
+
+func (p *PunctMatcher) Match(r rune) (bool, error) {
+	return isPunctuation(r), nil
+}
+
+func (p *PunctMatcher) isPredefinedClass() {}
+
+type UpperMatcher struct{}
+
+func (u *UpperMatcher) Match(r rune) (bool, error) {
+	return isUpper(r), nil
+}
+
+func (u *UpperMatcher) isPredefinedClass() {}
+
+type XDigitMatcher struct{}
+
+func (x *XDigitMatcher) Match(r rune) (bool, error) {
+	return isHexDigit(r), nil
+}
+
+func (x *XDigitMatcher) isPredefinedClass() {}
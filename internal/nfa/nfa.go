@@ -1,7 +1,11 @@
 // Package nfa defines the structure of an NFA
 package nfa
 
-import "github.com/mmarchesotti/build-your-own-grep/internal/matcher"
+import (
+	"github.com/mmarchesotti/build-your-own-grep/internal/anchor"
+	"github.com/mmarchesotti/build-your-own-grep/internal/boundary"
+	"github.com/mmarchesotti/build-your-own-grep/internal/matcher"
+)
 
 type Fragment struct {
 	Start State
@@ -46,16 +50,115 @@ type CaptureEndState struct {
 	GroupIndex int
 }
 
-type StartAnchorState struct {
+// AtomicGroupState runs the fragment starting at Body, which ends in its own
+// AcceptingState, and continues at Out from the first match it finds. The
+// other ways the body could have matched are never tried.
+type AtomicGroupState struct {
 	BaseState
-	Out State
+	Body State
+	Out  State
 }
 
-type EndAnchorState struct {
+// LookaheadState runs the fragment starting at Body, which ends in its own
+// AcceptingState, from the current position. It continues at Out without
+// consuming input if the body matches, or if it does not and Negated is set.
+type LookaheadState struct {
 	BaseState
-	Out State
+	Body    State
+	Out     State
+	Negated bool
+}
+
+// LookbehindState is like LookaheadState, except the body must match a span
+// that ends at the current position. The body is between MinWidth and
+// MaxWidth runes long, so only those starting points are tried.
+type LookbehindState struct {
+	BaseState
+	Body     State
+	Out      State
+	Negated  bool
+	MinWidth int
+	MaxWidth int
+}
+
+// BackReferenceState consumes the text most recently captured by the group
+// GroupIndex and continues at Out. It fails if the group has not
+// participated in the match.
+type BackReferenceState struct {
+	BaseState
+	Out             State
+	GroupIndex      int
+	CaseInsensitive bool
+}
+
+// SubroutineCallState runs the capture group GroupIndex again from its
+// start state, Target, and continues at Out once that group's end is
+// reached. Target is filled in after the whole NFA has been built.
+type SubroutineCallState struct {
+	BaseState
+	Out        State
+	Target     State
+	GroupIndex int
+}
+
+// ConditionalState continues at Yes if the capture group GroupIndex has
+// participated in the match so far, and at No otherwise.
+type ConditionalState struct {
+	BaseState
+	GroupIndex int
+	Yes        State
+	No         State
+}
+
+// AnchorState continues at Out when the current position satisfies the
+// Kind of anchor.
+type AnchorState struct {
+	BaseState
+	Out  State
+	Kind anchor.Anchor
+}
+
+// WordBoundaryState continues at Out when the runes on either side of the
+// current position satisfy the Kind of boundary.
+type WordBoundaryState struct {
+	BaseState
+	Out  State
+	Kind boundary.Boundary
 }
 
 type AcceptingState struct {
 	BaseState
 }
+
+// Successors returns the states s can move to. The bodies of atomic groups
+// and lookarounds are included, but the target of a subroutine call is not.
+func Successors(s State) []State {
+	switch st := s.(type) {
+	case *SplitState:
+		return []State{st.Branch1, st.Branch2}
+	case *MatcherState:
+		return []State{st.Out}
+	case *CaptureStartState:
+		return []State{st.Out}
+	case *CaptureEndState:
+		return []State{st.Out}
+	case *AtomicGroupState:
+		return []State{st.Body, st.Out}
+	case *LookaheadState:
+		return []State{st.Body, st.Out}
+	case *LookbehindState:
+		return []State{st.Body, st.Out}
+	case *BackReferenceState:
+		return []State{st.Out}
+	case *SubroutineCallState:
+		return []State{st.Out}
+	case *ConditionalState:
+		return []State{st.Yes, st.No}
+	case *AnchorState:
+		return []State{st.Out}
+	case *WordBoundaryState:
+		return []State{st.Out}
+	default:
+		return nil
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"unicode/utf8"
 
+	"github.com/mmarchesotti/build-your-own-grep/internal/anchor"
+	"github.com/mmarchesotti/build-your-own-grep/internal/boundary"
+	"github.com/mmarchesotti/build-your-own-grep/internal/matcher"
 	"github.com/mmarchesotti/build-your-own-grep/internal/nfa"
 )
 
@@ -13,14 +16,140 @@ type Capture struct {
 	End   int
 }
 
+// Semantics decides which of the matches that start at the same position is
+// reported, and with which captures.
+type Semantics int
+
+const (
+	// LeftmostFirst reports the match the pattern prefers, as Perl does.
+	// Alternatives are tried from left to right, greedy quantifiers repeat
+	// as often as they can and lazy ones as rarely as they can, and the
+	// first way to reach the end of the pattern wins. The captures are
+	// those set along that path.
+	LeftmostFirst Semantics = iota
+	// LeftmostLongest reports the longest match, as POSIX does. Among the
+	// paths that make it, the captures are settled group by group, in the
+	// order of their opening parentheses: a group that participated beats
+	// one that did not, then an earlier start wins, then a later end. A
+	// repeated group reports its last iteration, as in LeftmostFirst. Any
+	// remaining tie goes to the path LeftmostFirst would take. Atomic
+	// groups and lookarounds still keep the first way their body matches.
+	// Without backreferences, the rules are applied where paths meet at a
+	// state rather than to whole paths, so that each state is only walked
+	// again from a position when it is reached with preferred captures.
+	LeftmostLongest
+)
+
+// DefaultMaxRecursionDepth is how deeply subroutine calls and recursion
+// may nest unless the caller chooses another limit.
+const DefaultMaxRecursionDepth = 1000
+
 type thread struct {
 	state     nfa.State
 	lineIndex int
 	captures  []Capture
+	calls     *callFrame
+}
+
+// callFrame records a subroutine call that has not returned yet. The call
+// was made at lineIndex, returns when the walk reaches the end of the called
+// group, and continues at returnState with the captures the caller had.
+// Frames are shared between calls with the same contents, and id tells them
+// apart in the visited memo.
+type callFrame struct {
+	id          int
+	groupIndex  int
+	returnState nfa.State
+	lineIndex   int
+	captures    []Capture
+	depth       int
+	parent      *callFrame
+}
+
+// key identifies a thread for the visited memo. Besides the state and the
+// position it records which groups have participated, since a conditional
+// can take a different branch depending on that, and the pending calls,
+// since they decide where the walk returns to. With exactCaptures set it
+// records the captures themselves instead, so that no path with different
+// captures is skipped.
+func (t *thread) key(exactCaptures bool) string {
+	if exactCaptures {
+		return fmt.Sprintf("%p-%d-%v-%d", t.state, t.lineIndex, t.captures, t.calls.frameID())
+	}
+	participated := make([]byte, len(t.captures))
+	for i, capture := range t.captures {
+		participated[i] = '0'
+		if capture.End != -1 {
+			participated[i] = '1'
+		}
+	}
+	return fmt.Sprintf("%p-%d-%s-%d", t.state, t.lineIndex, participated, t.calls.frameID())
+}
+
+// frameID returns the id of the frame, or 0 when there are no pending calls.
+func (f *callFrame) frameID() int {
+	if f == nil {
+		return 0
+	}
+	return f.id
 }
 
-func (t *thread) key() string {
-	return fmt.Sprintf("%p-%d", t.state, t.lineIndex)
+// callDepth returns how many calls are pending, this one included.
+func (f *callFrame) callDepth() int {
+	if f == nil {
+		return 0
+	}
+	return f.depth
+}
+
+// isReentry reports whether a call to groupIndex at lineIndex would repeat
+// one of the pending calls without the input having moved on. Such a call
+// can only recurse until the depth limit, so it fails, as in PCRE.
+func (f *callFrame) isReentry(groupIndex int, lineIndex int) bool {
+	for frame := f; frame != nil; frame = frame.parent {
+		if frame.groupIndex == groupIndex && frame.lineIndex == lineIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// walker holds the settings shared by every walk of one simulation.
+type walker struct {
+	line []byte
+	// exactCaptures makes the visited memo tell threads apart by the text
+	// their groups captured, rather than only by which groups participated.
+	// Backreferences need it, since their future depends on that text.
+	exactCaptures bool
+	// maxRecursionDepth is how many subroutine calls may be pending at
+	// once. A path that would go deeper fails.
+	maxRecursionDepth int
+	semantics         Semantics
+	// frames holds every call frame made so far, by contents. Keeping them
+	// here also keeps their ids unique for the whole simulation.
+	frames map[string]*callFrame
+}
+
+// enterCall returns the frame for a call to groupIndex made at lineIndex
+// from inside parent, which continues at returnState with captures. A call
+// with the same contents as an earlier one gets the same frame, so that the
+// visited memo sees the two call stacks as one.
+func (w *walker) enterCall(groupIndex int, returnState nfa.State, lineIndex int, captures []Capture, parent *callFrame) *callFrame {
+	frameKey := fmt.Sprintf("%d-%p-%d-%v-%d", groupIndex, returnState, lineIndex, captures, parent.frameID())
+	if frame, ok := w.frames[frameKey]; ok {
+		return frame
+	}
+	frame := &callFrame{
+		id:          len(w.frames) + 1,
+		groupIndex:  groupIndex,
+		returnState: returnState,
+		lineIndex:   lineIndex,
+		captures:    copyCaptures(captures),
+		depth:       parent.callDepth() + 1,
+		parent:      parent,
+	}
+	w.frames[frameKey] = frame
+	return frame
 }
 
 type task struct {
@@ -35,38 +164,91 @@ type undoEntry struct {
 	oldValue     int
 }
 
-func Simulate(line []byte, fragment nfa.Fragment, captureCount int) (<-chan []Capture, error) {
-	out := make(chan []Capture)
+// Simulate streams the captures of the matches of the fragment in line,
+// from left to right and without overlapping. At each position, semantics
+// decides which match is reported. It remembers the states it has visited
+// at each position, so it never does the same work twice, but this is only
+// sound when a path's future does not depend on the text its groups
+// captured. Patterns with backreferences must use Backtrack instead. The
+// channel must be read until it is closed, or the goroutine that fills it
+// never exits; First only looks for the first match.
+func Simulate(line []byte, fragment nfa.Fragment, captureCount int, semantics Semantics) (<-chan []Capture, error) {
+	return newSimulator(line, semantics).simulate(fragment, captureCount)
+}
 
-	go func() {
-		defer close(out)
+// First returns the captures of the first match Simulate would stream, or
+// nil when there is none. It stops as soon as it finds it, in the calling
+// goroutine.
+func First(line []byte, fragment nfa.Fragment, captureCount int, semantics Semantics) []Capture {
+	return newSimulator(line, semantics).first(fragment, captureCount)
+}
 
-		searchIndex := 0
-		for searchIndex <= len(line) {
+// Backtrack streams the same matches as Simulate, but only skips a state it
+// has already visited at the same position when the groups captured the same
+// text, so it can take exponential time. It is what patterns with
+// backreferences and subroutine calls need. Paths that nest more than
+// maxRecursionDepth calls fail. As with Simulate, the channel must be read
+// until it is closed.
+func Backtrack(line []byte, fragment nfa.Fragment, captureCount int, maxRecursionDepth int, semantics Semantics) (<-chan []Capture, error) {
+	return newBacktracker(line, maxRecursionDepth, semantics).simulate(fragment, captureCount)
+}
 
-			stream := findMatchAt(fragment.Start, line, searchIndex, captureCount)
+// FirstBacktrack is First for the walk Backtrack does.
+func FirstBacktrack(line []byte, fragment nfa.Fragment, captureCount int, maxRecursionDepth int, semantics Semantics) []Capture {
+	return newBacktracker(line, maxRecursionDepth, semantics).first(fragment, captureCount)
+}
 
-			foundAnyAtThisIndex := false
-			maxEndIndex := searchIndex
+func newSimulator(line []byte, semantics Semantics) *walker {
+	return &walker{
+		line:              line,
+		maxRecursionDepth: DefaultMaxRecursionDepth,
+		semantics:         semantics,
+		frames:            make(map[string]*callFrame),
+	}
+}
 
-			for match := range stream {
-				foundAnyAtThisIndex = true
+func newBacktracker(line []byte, maxRecursionDepth int, semantics Semantics) *walker {
+	return &walker{
+		line:              line,
+		exactCaptures:     true,
+		maxRecursionDepth: maxRecursionDepth,
+		semantics:         semantics,
+		frames:            make(map[string]*callFrame),
+	}
+}
 
-				if match[0].End > maxEndIndex {
-					maxEndIndex = match[0].End
-				}
+// first returns the captures of the leftmost match, or nil if there is none.
+func (w *walker) first(fragment nfa.Fragment, captureCount int) []Capture {
+	for searchIndex := 0; searchIndex <= len(w.line); searchIndex = nextRuneIndex(w.line, searchIndex) {
+		if match := w.findMatchAt(fragment.Start, searchIndex, captureCount); match != nil {
+			return match
+		}
+	}
+	return nil
+}
+
+func (w *walker) simulate(fragment nfa.Fragment, captureCount int) (<-chan []Capture, error) {
+	line := w.line
 
-				out <- match
+	out := make(chan []Capture)
+
+	go func() {
+		defer close(out)
+
+		searchIndex := 0
+		for searchIndex <= len(line) {
+			match := w.findMatchAt(fragment.Start, searchIndex, captureCount)
+			if match == nil {
+				searchIndex = nextRuneIndex(line, searchIndex)
+				continue
 			}
 
-			if foundAnyAtThisIndex {
-				if maxEndIndex > searchIndex {
-					searchIndex = maxEndIndex
-				} else {
-					searchIndex++
-				}
+			out <- match
+
+			if match[0].End > searchIndex {
+				searchIndex = match[0].End
 			} else {
-				searchIndex++
+				searchIndex = nextRuneIndex(line, searchIndex)
 			}
 		}
 	}()
@@ -74,167 +256,536 @@ func Simulate(line []byte, fragment nfa.Fragment, captureCount int) (<-chan []Ca
 	return out, nil
 }
 
-func findMatchAt(startState nfa.State, line []byte, startIndex int, captureCount int) <-chan []Capture {
-	out := make(chan []Capture)
-
-	go func() {
-		defer close(out)
-		stack := []task{}
-
-		initialCaptures := make([]Capture, captureCount)
-		for i := range initialCaptures {
-			initialCaptures[i] = Capture{Start: -1, End: -1}
+// findMatchAt returns the captures of the match that starts at startIndex,
+// chosen according to the walker's semantics, or nil if there is none.
+func (w *walker) findMatchAt(startState nfa.State, startIndex int, captureCount int) []Capture {
+	longest := -1
+	if w.semantics == LeftmostLongest {
+		// Finding where the longest match ends takes a walk as cheap as
+		// under LeftmostFirst, so only the positions where there is a
+		// match pay for comparing captures.
+		longest = w.longestMatchEnd(startState, startIndex, captureCount)
+		if longest == -1 {
+			return nil
 		}
+	}
 
-		initialThread := thread{
-			state:     startState,
-			lineIndex: startIndex,
-			captures:  initialCaptures,
+	var best []Capture
+	w.walk(startState, startIndex, emptyCaptures(captureCount), nil, func(lineIndex int, captures []Capture) bool {
+		if w.semantics == LeftmostFirst {
+			best = copyCaptures(captures)
+			return false
 		}
-		stack = append(stack, task{
-			isRevert: false,
-			thread:   initialThread,
-			undoLog:  nil,
-		})
+		if lineIndex == longest && (best == nil || isPreferredPOSIX(captures, best)) {
+			best = copyCaptures(captures)
+		}
+		return true
+	})
+	return best
+}
 
-		visited := make(map[string]bool)
+// longestMatchEnd returns where the longest match that starts at startIndex
+// ends, or -1 if there is none. Any path will do to reach an end, so the
+// walk forgets about captures as LeftmostFirst does.
+func (w *walker) longestMatchEnd(startState nfa.State, startIndex int, captureCount int) int {
+	probe := *w
+	probe.semantics = LeftmostFirst
+
+	longest := -1
+	probe.walk(startState, startIndex, emptyCaptures(captureCount), nil, func(lineIndex int, _ []Capture) bool {
+		longest = max(longest, lineIndex)
+		return true
+	})
+	return longest
+}
 
-		for len(stack) > 0 {
-			currentTask := stack[len(stack)-1]
-			stack = stack[:len(stack)-1]
+// emptyCaptures returns captures for captureCount groups, none of which has
+// participated.
+func emptyCaptures(captureCount int) []Capture {
+	captures := make([]Capture, captureCount)
+	for i := range captures {
+		captures[i] = Capture{Start: -1, End: -1}
+	}
+	return captures
+}
 
-			if currentTask.isRevert {
-				for _, entry := range currentTask.undoLog {
-					if entry.isStart {
-						currentTask.thread.captures[entry.captureIndex].Start = entry.oldValue
-					} else {
-						currentTask.thread.captures[entry.captureIndex].End = entry.oldValue
-					}
+// isPreferredPOSIX reports whether a match with captures a should be
+// reported instead of one with captures b under LeftmostLongest. Both
+// matches start at the same position. The walk also uses it to compare the
+// captures of two threads that meet at a state, where a group may have
+// started but not ended yet; then the one that started earlier wins.
+func isPreferredPOSIX(a []Capture, b []Capture) bool {
+	if a[0].End != b[0].End {
+		return a[0].End > b[0].End
+	}
+	for i := 1; i < len(a); i++ {
+		aParticipated, bParticipated := a[i].End != -1, b[i].End != -1
+		if aParticipated != bParticipated {
+			return aParticipated
+		}
+		if a[i].Start != b[i].Start {
+			if a[i].Start == -1 || b[i].Start == -1 {
+				return b[i].Start == -1
+			}
+			return a[i].Start < b[i].Start
+		}
+		if a[i].End != b[i].End {
+			return a[i].End > b[i].End
+		}
+	}
+	return false
+}
+
+// walk explores the paths through the NFA that start at startState and
+// startIndex, in order of preference, and calls accept with the line index
+// and captures of every AcceptingState it reaches. The captures slice is
+// updated in place, so accept must copy it to keep it. The walk stops as soon
+// as accept returns false. The walk starts inside the given pending calls.
+func (w *walker) walk(startState nfa.State, startIndex int, captures []Capture, calls *callFrame, accept func(lineIndex int, captures []Capture) bool) {
+	line := w.line
+	stack := []task{}
+
+	initialThread := thread{
+		state:     startState,
+		lineIndex: startIndex,
+		captures:  captures,
+		calls:     calls,
+	}
+	stack = append(stack, task{
+		isRevert: false,
+		thread:   initialThread,
+		undoLog:  nil,
+	})
+
+	// visited maps the key of every thread seen so far to its captures.
+	// Under LeftmostLongest a thread that meets an earlier one is still
+	// explored when its captures are preferred, since they may end up in
+	// the reported match. Otherwise the first thread to get there wins.
+	visited := make(map[string][]Capture)
+	keepsBest := w.semantics == LeftmostLongest && !w.exactCaptures
+
+	for len(stack) > 0 {
+		currentTask := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if currentTask.isRevert {
+			for _, entry := range currentTask.undoLog {
+				if entry.isStart {
+					currentTask.thread.captures[entry.captureIndex].Start = entry.oldValue
+				} else {
+					currentTask.thread.captures[entry.captureIndex].End = entry.oldValue
 				}
-				continue
 			}
+			continue
+		}
 
-			threadKey := currentTask.thread.key()
-			if visited[threadKey] {
+		// A thread that repeats an earlier one can only repeat its paths.
+		// Skipping it also stops loops whose body matches the empty string
+		// from going round forever.
+		threadKey := currentTask.thread.key(w.exactCaptures)
+		if best, seen := visited[threadKey]; seen {
+			if !keepsBest || !isPreferredPOSIX(currentTask.thread.captures, best) {
 				continue
 			}
-			visited[threadKey] = true
+		}
+		visited[threadKey] = nil
+		if keepsBest {
+			visited[threadKey] = copyCaptures(currentTask.thread.captures)
+		}
 
-			currentState := currentTask.thread.state
-			switch st := currentState.(type) {
-			case *nfa.AcceptingState:
-				resultCopy := copyCaptures(currentTask.thread.captures)
-				out <- resultCopy
-				continue
-			case *nfa.MatcherState:
-				if currentTask.thread.lineIndex < len(line) {
-					r, size := utf8.DecodeRune(line[currentTask.thread.lineIndex:])
-					match, _ := st.Matcher.Match(r)
-					if match {
-						nextThread := thread{
-							state:     st.Out,
-							lineIndex: currentTask.thread.lineIndex + size,
-							captures:  currentTask.thread.captures,
-						}
-						stack = append(stack, task{
-							isRevert: false,
-							thread:   nextThread,
-						})
-					}
+		currentState := currentTask.thread.state
+		switch st := currentState.(type) {
+		case *nfa.AcceptingState:
+			if !accept(currentTask.thread.lineIndex, currentTask.thread.captures) {
+				return
+			}
+			continue
+		case *nfa.MatcherState:
+			if currentTask.thread.lineIndex < len(line) {
+				r, size := utf8.DecodeRune(line[currentTask.thread.lineIndex:])
+				match, err := st.Matcher.Match(r)
+				if err != nil {
+					// Matchers are validated when the NFA is built, so an
+					// error here means the automaton itself is broken.
+					// Abandon the search instead of guessing at a result.
+					return
 				}
-			case *nfa.SplitState:
-				thread1 := thread{
-					state:     st.Branch1,
-					lineIndex: currentTask.thread.lineIndex,
-					captures:  currentTask.thread.captures,
+				if match {
+					nextThread := thread{
+						state:     st.Out,
+						lineIndex: currentTask.thread.lineIndex + size,
+						captures:  currentTask.thread.captures,
+						calls:     currentTask.thread.calls,
+					}
+					stack = append(stack, task{
+						isRevert: false,
+						thread:   nextThread,
+					})
 				}
-				thread2 := thread{
-					state:     st.Branch2,
+			}
+		case *nfa.SplitState:
+			thread1 := thread{
+				state:     st.Branch1,
+				lineIndex: currentTask.thread.lineIndex,
+				captures:  currentTask.thread.captures,
+				calls:     currentTask.thread.calls,
+			}
+			thread2 := thread{
+				state:     st.Branch2,
+				lineIndex: currentTask.thread.lineIndex,
+				captures:  currentTask.thread.captures,
+				calls:     currentTask.thread.calls,
+			}
+			stack = append(stack, task{
+				isRevert: false,
+				thread:   thread2,
+			})
+			stack = append(stack, task{
+				isRevert: false,
+				thread:   thread1,
+			})
+		case *nfa.CaptureStartState:
+			undo := undoEntry{
+				captureIndex: st.GroupIndex,
+				isStart:      true,
+				oldValue:     currentTask.thread.captures[st.GroupIndex].Start,
+			}
+
+			currentTask.thread.captures[st.GroupIndex].Start = currentTask.thread.lineIndex
+
+			nextThread := thread{
+				state:     st.Out,
+				lineIndex: currentTask.thread.lineIndex,
+				captures:  currentTask.thread.captures,
+				calls:     currentTask.thread.calls,
+			}
+
+			stack = append(stack, task{
+				isRevert: true,
+				thread:   currentTask.thread, undoLog: []undoEntry{undo},
+			})
+			stack = append(stack, task{
+				isRevert: false,
+				thread:   nextThread,
+			})
+		case *nfa.CaptureEndState:
+			if calls := currentTask.thread.calls; calls != nil && calls.groupIndex == st.GroupIndex {
+				// The end of a called group returns from the call. The
+				// captures set inside it are dropped, as in PCRE.
+				nextThread := thread{
+					state:     calls.returnState,
 					lineIndex: currentTask.thread.lineIndex,
-					captures:  currentTask.thread.captures,
+					captures:  copyCaptures(calls.captures),
+					calls:     calls.parent,
 				}
 				stack = append(stack, task{
 					isRevert: false,
-					thread:   thread2,
+					thread:   nextThread,
+				})
+				continue
+			}
+
+			undo := undoEntry{
+				captureIndex: st.GroupIndex,
+				isStart:      false,
+				oldValue:     currentTask.thread.captures[st.GroupIndex].End,
+			}
+			currentTask.thread.captures[st.GroupIndex].End = currentTask.thread.lineIndex
+
+			nextThread := thread{
+				state:     st.Out,
+				lineIndex: currentTask.thread.lineIndex,
+				captures:  currentTask.thread.captures,
+				calls:     currentTask.thread.calls,
+			}
+
+			stack = append(stack, task{
+				isRevert: true,
+				thread:   currentTask.thread, undoLog: []undoEntry{undo},
+			})
+			stack = append(stack, task{
+				isRevert: false,
+				thread:   nextThread,
+			})
+		case *nfa.AtomicGroupState:
+			bodyMatched := false
+			var bodyEndIndex int
+			var bodyCaptures []Capture
+			w.walk(st.Body, currentTask.thread.lineIndex, copyCaptures(currentTask.thread.captures), currentTask.thread.calls,
+				func(lineIndex int, captures []Capture) bool {
+					bodyMatched = true
+					bodyEndIndex = lineIndex
+					bodyCaptures = copyCaptures(captures)
+					return false
 				})
+			if bodyMatched {
+				nextThread := thread{
+					state:     st.Out,
+					lineIndex: bodyEndIndex,
+					captures:  bodyCaptures,
+					calls:     currentTask.thread.calls,
+				}
 				stack = append(stack, task{
 					isRevert: false,
-					thread:   thread1,
+					thread:   nextThread,
 				})
-			case *nfa.CaptureStartState:
-				undo := undoEntry{
-					captureIndex: st.GroupIndex,
-					isStart:      true,
-					oldValue:     currentTask.thread.captures[st.GroupIndex].Start,
-				}
-
-				currentTask.thread.captures[st.GroupIndex].Start = currentTask.thread.lineIndex
-
+			}
+		case *nfa.LookaheadState:
+			bodyMatched, bodyCaptures := w.matchLookahead(st, currentTask.thread.lineIndex, currentTask.thread.captures, currentTask.thread.calls)
+			if bodyMatched != st.Negated {
 				nextThread := thread{
 					state:     st.Out,
 					lineIndex: currentTask.thread.lineIndex,
-					captures:  currentTask.thread.captures,
+					captures:  bodyCaptures,
+					calls:     currentTask.thread.calls,
 				}
-
 				stack = append(stack, task{
-					isRevert: true,
-					thread:   currentTask.thread, undoLog: []undoEntry{undo},
+					isRevert: false,
+					thread:   nextThread,
 				})
+			}
+		case *nfa.LookbehindState:
+			bodyMatched, bodyCaptures := w.matchLookbehind(st, currentTask.thread.lineIndex, currentTask.thread.captures, currentTask.thread.calls)
+			if bodyMatched != st.Negated {
+				nextThread := thread{
+					state:     st.Out,
+					lineIndex: currentTask.thread.lineIndex,
+					captures:  bodyCaptures,
+					calls:     currentTask.thread.calls,
+				}
 				stack = append(stack, task{
 					isRevert: false,
 					thread:   nextThread,
 				})
-			case *nfa.CaptureEndState:
-				undo := undoEntry{
-					captureIndex: st.GroupIndex,
-					isStart:      false,
-					oldValue:     currentTask.thread.captures[st.GroupIndex].End,
-				}
-				currentTask.thread.captures[st.GroupIndex].End = currentTask.thread.lineIndex
-
+			}
+		case *nfa.AnchorState:
+			if isAtAnchor(st.Kind, line, currentTask.thread.lineIndex) {
 				nextThread := thread{
 					state:     st.Out,
 					lineIndex: currentTask.thread.lineIndex,
 					captures:  currentTask.thread.captures,
+					calls:     currentTask.thread.calls,
 				}
-
 				stack = append(stack, task{
-					isRevert: true,
-					thread:   currentTask.thread, undoLog: []undoEntry{undo},
+					isRevert: false,
+					thread:   nextThread,
 				})
+			}
+		case *nfa.BackReferenceState:
+			capture := currentTask.thread.captures[st.GroupIndex]
+			if capture.End == -1 {
+				continue
+			}
+			endIndex, ok := matchBackReference(line, currentTask.thread.lineIndex, capture, st.CaseInsensitive)
+			if ok {
+				nextThread := thread{
+					state:     st.Out,
+					lineIndex: endIndex,
+					captures:  currentTask.thread.captures,
+					calls:     currentTask.thread.calls,
+				}
 				stack = append(stack, task{
 					isRevert: false,
 					thread:   nextThread,
 				})
-			case *nfa.StartAnchorState:
-				if currentTask.thread.lineIndex == 0 {
-					nextThread := thread{
-						state:     st.Out,
-						lineIndex: currentTask.thread.lineIndex,
-						captures:  currentTask.thread.captures,
-					}
-					stack = append(stack, task{
-						isRevert: false,
-						thread:   nextThread,
-					})
-				}
-			case *nfa.EndAnchorState:
-				if currentTask.thread.lineIndex == len(line) {
-					nextThread := thread{
-						state:     st.Out,
-						lineIndex: currentTask.thread.lineIndex,
-						captures:  currentTask.thread.captures,
-					}
-					stack = append(stack, task{
-						isRevert: false,
-						thread:   nextThread,
-					})
+			}
+		case *nfa.SubroutineCallState:
+			calls := currentTask.thread.calls
+			if calls.isReentry(st.GroupIndex, currentTask.thread.lineIndex) {
+				continue
+			}
+			if calls.callDepth()+1 > w.maxRecursionDepth {
+				continue
+			}
+			frame := w.enterCall(st.GroupIndex, st.Out, currentTask.thread.lineIndex, currentTask.thread.captures, calls)
+			nextThread := thread{
+				state:     st.Target,
+				lineIndex: currentTask.thread.lineIndex,
+				captures:  currentTask.thread.captures,
+				calls:     frame,
+			}
+			stack = append(stack, task{
+				isRevert: false,
+				thread:   nextThread,
+			})
+		case *nfa.ConditionalState:
+			next := st.No
+			if currentTask.thread.captures[st.GroupIndex].End != -1 {
+				next = st.Yes
+			}
+			nextThread := thread{
+				state:     next,
+				lineIndex: currentTask.thread.lineIndex,
+				captures:  currentTask.thread.captures,
+				calls:     currentTask.thread.calls,
+			}
+			stack = append(stack, task{
+				isRevert: false,
+				thread:   nextThread,
+			})
+		case *nfa.WordBoundaryState:
+			if isAtWordBoundary(st.Kind, line, currentTask.thread.lineIndex) {
+				nextThread := thread{
+					state:     st.Out,
+					lineIndex: currentTask.thread.lineIndex,
+					captures:  currentTask.thread.captures,
+					calls:     currentTask.thread.calls,
 				}
+				stack = append(stack, task{
+					isRevert: false,
+					thread:   nextThread,
+				})
 			}
 		}
-	}()
+	}
+}
+
+// matchLookahead reports whether the body of a lookahead matches at
+// lineIndex. The captures to continue with are those set by the body when a
+// positive lookahead matches, and the unchanged captures otherwise, since a
+// negative lookahead only succeeds when its body fails.
+func (w *walker) matchLookahead(st *nfa.LookaheadState, lineIndex int, captures []Capture, calls *callFrame) (bool, []Capture) {
+	bodyMatched := false
+	bodyCaptures := captures
+	w.walk(st.Body, lineIndex, copyCaptures(captures), calls, func(_ int, result []Capture) bool {
+		bodyMatched = true
+		if !st.Negated {
+			bodyCaptures = copyCaptures(result)
+		}
+		return false
+	})
+	return bodyMatched, bodyCaptures
+}
+
+// matchLookbehind reports whether the body of a lookbehind matches a span
+// ending at lineIndex, trying the shortest candidate span first. Captures are
+// handled as in matchLookahead.
+func (w *walker) matchLookbehind(st *nfa.LookbehindState, lineIndex int, captures []Capture, calls *callFrame) (bool, []Capture) {
+	line := w.line
+	startIndex := lineIndex
+	for range st.MinWidth {
+		if startIndex == 0 {
+			return false, captures
+		}
+		_, size := utf8.DecodeLastRune(line[:startIndex])
+		startIndex -= size
+	}
+
+	for runeWidth := st.MinWidth; runeWidth <= st.MaxWidth; runeWidth++ {
+		bodyMatched := false
+		bodyCaptures := captures
+		w.walk(st.Body, startIndex, copyCaptures(captures), calls, func(endIndex int, result []Capture) bool {
+			if endIndex != lineIndex {
+				return true
+			}
+			bodyMatched = true
+			if !st.Negated {
+				bodyCaptures = copyCaptures(result)
+			}
+			return false
+		})
+		if bodyMatched {
+			return true, bodyCaptures
+		}
+
+		if startIndex == 0 {
+			break
+		}
+		_, size := utf8.DecodeLastRune(line[:startIndex])
+		startIndex -= size
+	}
+	return false, captures
+}
+
+// matchBackReference reports whether the captured text appears again at
+// lineIndex and returns the index just past the repetition. With
+// caseInsensitive set, runes are compared under simple case folding, so the
+// repetition may differ from the capture in length.
+func matchBackReference(line []byte, lineIndex int, capture Capture, caseInsensitive bool) (int, bool) {
+	if caseInsensitive {
+		captured := line[capture.Start:capture.End]
+		for len(captured) > 0 {
+			if lineIndex >= len(line) {
+				return 0, false
+			}
+			want, wantSize := utf8.DecodeRune(captured)
+			got, gotSize := utf8.DecodeRune(line[lineIndex:])
+			if !matcher.EqualFold(got, want) {
+				return 0, false
+			}
+			captured = captured[wantSize:]
+			lineIndex += gotSize
+		}
+		return lineIndex, true
+	}
+
+	length := capture.End - capture.Start
+	if lineIndex+length > len(line) {
+		return 0, false
+	}
+	for i := range length {
+		if line[lineIndex+i] != line[capture.Start+i] {
+			return 0, false
+		}
+	}
+	return lineIndex + length, true
+}
+
+// isAtAnchor reports whether the position lineIndex satisfies the given kind
+// of anchor.
+func isAtAnchor(kind anchor.Anchor, line []byte, lineIndex int) bool {
+	switch kind {
+	case anchor.TextStart:
+		return lineIndex == 0
+	case anchor.TextEnd:
+		return lineIndex == len(line)
+	case anchor.TextEndBeforeNewline:
+		return lineIndex == len(line) || (lineIndex == len(line)-1 && line[lineIndex] == '\n')
+	case anchor.LineStart:
+		return lineIndex == 0 || line[lineIndex-1] == '\n'
+	case anchor.LineEnd:
+		return lineIndex == len(line) || line[lineIndex] == '\n'
+	default:
+		return false
+	}
+}
+
+// isAtWordBoundary reports whether the position lineIndex satisfies the
+// given kind of word boundary, looking at the runes on both sides of it.
+func isAtWordBoundary(kind boundary.Boundary, line []byte, lineIndex int) bool {
+	wordBefore := false
+	if lineIndex > 0 {
+		r, _ := utf8.DecodeLastRune(line[:lineIndex])
+		wordBefore = matcher.IsWordCharacter(r)
+	}
+	wordAfter := false
+	if lineIndex < len(line) {
+		r, _ := utf8.DecodeRune(line[lineIndex:])
+		wordAfter = matcher.IsWordCharacter(r)
+	}
+
+	switch kind {
+	case boundary.WordBoundary:
+		return wordBefore != wordAfter
+	case boundary.NonWordBoundary:
+		return wordBefore == wordAfter
+	case boundary.WordStart:
+		return !wordBefore && wordAfter
+	case boundary.WordEnd:
+		return wordBefore && !wordAfter
+	default:
+		return false
+	}
+}
 
-	return out
+// nextRuneIndex returns the index of the rune following the one at index, so
+// a search never starts in the middle of a multi-byte character.
+func nextRuneIndex(line []byte, index int) int {
+	if index >= len(line) {
+		return index + 1
+	}
+	_, size := utf8.DecodeRune(line[index:])
+	return index + size
 }
 
 func copyCaptures(src []Capture) []Capture {
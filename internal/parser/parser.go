@@ -4,7 +4,9 @@ package parser
 import (
 	"fmt"
 
+	"github.com/mmarchesotti/build-your-own-grep/internal/anchor"
 	"github.com/mmarchesotti/build-your-own-grep/internal/ast"
+	"github.com/mmarchesotti/build-your-own-grep/internal/inlineflag"
 	"github.com/mmarchesotti/build-your-own-grep/internal/token"
 )
 
@@ -12,16 +14,42 @@ type Parser struct {
 	tokens       []token.Token
 	position     int
 	captureIndex int
+	groupNames   map[string]int
+	// namedReferences holds \k<name> references until the whole pattern
+	// is parsed, so a reference may name a group defined after it.
+	namedReferences map[*ast.BackReferenceNode]string
+	// references holds every backreference so their group numbers can be
+	// checked once the number of groups is known.
+	references []*ast.BackReferenceNode
+	// conditionals and namedConditions do the same for the groups tested
+	// by conditionals.
+	conditionals    []*ast.ConditionalNode
+	namedConditions map[*ast.ConditionalNode]string
+	// calls and namedCalls do the same for subroutine calls.
+	calls      []*ast.SubroutineCallNode
+	namedCalls map[*ast.SubroutineCallNode]string
+	// flags are the inline modifiers in effect at the current position.
+	// They are baked into the nodes built while they are set.
+	flags inlineflag.Flags
 }
 
 func NewParser(tokens []token.Token) *Parser {
 	return &Parser{
-		tokens:       tokens,
-		position:     0,
-		captureIndex: 0,
+		tokens:          tokens,
+		position:        0,
+		captureIndex:    0,
+		groupNames:      map[string]int{},
+		namedReferences: map[*ast.BackReferenceNode]string{},
+		namedConditions: map[*ast.ConditionalNode]string{},
+		namedCalls:      map[*ast.SubroutineCallNode]string{},
 	}
 }
 
+// GroupNames returns the index of every named capture group seen so far.
+func (p *Parser) GroupNames() map[string]int {
+	return p.groupNames
+}
+
 func (p *Parser) currentToken() token.Token {
 	if p.position >= len(p.tokens) {
 		return nil
@@ -78,19 +106,37 @@ func (p *Parser) parseFactor() (ast.ASTNode, error) {
 
 	for token.IsUnaryOperator(p.currentToken()) {
 		t := p.consumeToken()
-		switch t.(type) {
+		possessive := false
+		switch t := t.(type) {
 		case *token.OptionalQuantifier:
 			node = &ast.OptionalNode{
 				Child: node,
+				Lazy:  t.Lazy,
 			}
+			possessive = t.Possessive
 		case *token.KleeneClosure:
 			node = &ast.KleeneClosureNode{
 				Child: node,
+				Lazy:  t.Lazy,
 			}
+			possessive = t.Possessive
 		case *token.PositiveClosure:
 			node = &ast.PositiveClosureNode{
 				Child: node,
+				Lazy:  t.Lazy,
+			}
+			possessive = t.Possessive
+		case *token.RepetitionQuantifier:
+			node = &ast.RepetitionNode{
+				Child: node,
+				Min:   t.Min,
+				Max:   t.Max,
+				Lazy:  t.Lazy,
 			}
+			possessive = t.Possessive
+		}
+		if possessive {
+			node = &ast.AtomicGroupNode{Child: node}
 		}
 	}
 
@@ -102,41 +148,108 @@ func (p *Parser) parseAtom() (ast.ASTNode, error) {
 	case *token.GroupingOpener:
 		p.consumeToken()
 
-		p.captureIndex++
-		currentCaptureIndex := p.captureIndex
+		currentCaptureIndex := 0
+		if t.Kind == token.GroupCapturing {
+			p.captureIndex++
+			currentCaptureIndex = p.captureIndex
+		}
+		if t.Name != "" {
+			if _, exists := p.groupNames[t.Name]; exists {
+				return nil, fmt.Errorf("duplicate group name %q", t.Name)
+			}
+			p.groupNames[t.Name] = currentCaptureIndex
+		}
 
-		node, err := p.parseExpression()
+		enclosingFlags := p.flags
+		p.flags = p.flags.Apply(t.FlagsOn, t.FlagsOff)
+		var node ast.ASTNode
+		var err error
+		if t.Kind == token.GroupConditional {
+			node, err = p.parseConditional(t)
+		} else {
+			node, err = p.parseExpression()
+		}
 		if err != nil {
 			return nil, err
 		}
+		p.flags = enclosingFlags
 
 		if !token.IsGroupingCloser(p.currentToken()) {
 			return nil, fmt.Errorf("unmatched group opener")
 		}
 		p.consumeToken()
 
-		return &ast.CaptureGroupNode{
-			Child:      node,
-			GroupIndex: currentCaptureIndex,
-		}, nil
+		switch t.Kind {
+		case token.GroupNonCapturing, token.GroupConditional:
+			return node, nil
+		case token.GroupAtomic:
+			return &ast.AtomicGroupNode{Child: node}, nil
+		case token.GroupLookahead, token.GroupNegativeLookahead:
+			return &ast.LookaheadNode{
+				Child:   node,
+				Negated: t.Kind == token.GroupNegativeLookahead,
+			}, nil
+		case token.GroupLookbehind, token.GroupNegativeLookbehind:
+			return &ast.LookbehindNode{
+				Child:   node,
+				Negated: t.Kind == token.GroupNegativeLookbehind,
+			}, nil
+		default:
+			return &ast.CaptureGroupNode{
+				Child:      node,
+				GroupIndex: currentCaptureIndex,
+			}, nil
+		}
+	case *token.InlineFlags:
+		p.consumeToken()
+		p.flags = p.flags.Apply(t.On, t.Off)
+		if token.CanConcatenate(p.currentToken()) {
+			return p.parseAtom()
+		}
+		return &ast.EmptyNode{}, nil
+	case *token.BackReference:
+		p.consumeToken()
+		node := &ast.BackReferenceNode{
+			GroupIndex:      t.CaptureIndex,
+			CaseInsensitive: p.flags.Has(inlineflag.CaseInsensitive),
+		}
+		if t.Name != "" {
+			p.namedReferences[node] = t.Name
+		}
+		p.references = append(p.references, node)
+		return node, nil
+	case *token.SubroutineCall:
+		p.consumeToken()
+		node := &ast.SubroutineCallNode{GroupIndex: t.GroupIndex}
+		if t.Name != "" {
+			p.namedCalls[node] = t.Name
+		}
+		p.calls = append(p.calls, node)
+		return node, nil
 	case *token.Literal:
 		p.consumeToken()
 		node := &ast.LiteralNode{
-			Literal: t.Literal,
+			Literal:         t.Literal,
+			CaseInsensitive: p.flags.Has(inlineflag.CaseInsensitive),
 		}
 		return node, nil
 	case *token.CharacterSet:
 		p.consumeToken()
-		node := &ast.CharacterSetNode{
-			IsPositive:       t.IsPositive,
-			Literals:         t.Literals,
-			Ranges:           t.Ranges,
-			CharacterClasses: t.CharacterClasses,
+		node := newCharacterSetNode(t)
+		node.CaseInsensitive = p.flags.Has(inlineflag.CaseInsensitive)
+		return node, nil
+	case *token.UnicodeClass:
+		p.consumeToken()
+		node := &ast.UnicodeClassNode{
+			Name:    t.Name,
+			Negated: t.Negated,
 		}
 		return node, nil
 	case *token.Wildcard:
 		p.consumeToken()
-		node := &ast.WildcardNode{}
+		node := &ast.WildcardNode{
+			DotAll: p.flags.Has(inlineflag.DotAll),
+		}
 		return node, nil
 	case *token.Digit:
 		p.consumeToken()
@@ -146,13 +259,45 @@ func (p *Parser) parseAtom() (ast.ASTNode, error) {
 		p.consumeToken()
 		node := &ast.AlphaNumericNode{}
 		return node, nil
+	case *token.Whitespace:
+		p.consumeToken()
+		node := &ast.WhitespaceNode{}
+		return node, nil
+	case *token.NonDigit:
+		p.consumeToken()
+		node := &ast.NonDigitNode{}
+		return node, nil
+	case *token.NonAlphaNumeric:
+		p.consumeToken()
+		node := &ast.NonAlphaNumericNode{}
+		return node, nil
+	case *token.NonWhitespace:
+		p.consumeToken()
+		node := &ast.NonWhitespaceNode{}
+		return node, nil
 	case *token.StartAnchor:
 		p.consumeToken()
-		node := &ast.StartAnchorNode{}
+		kind := anchor.TextStart
+		if p.flags.Has(inlineflag.Multiline) {
+			kind = anchor.LineStart
+		}
+		node := &ast.AnchorNode{Kind: kind}
 		return node, nil
 	case *token.EndAnchor:
 		p.consumeToken()
-		node := &ast.EndAnchorNode{}
+		kind := anchor.TextEnd
+		if p.flags.Has(inlineflag.Multiline) {
+			kind = anchor.LineEnd
+		}
+		node := &ast.AnchorNode{Kind: kind}
+		return node, nil
+	case *token.Anchor:
+		p.consumeToken()
+		node := &ast.AnchorNode{Kind: t.Kind}
+		return node, nil
+	case *token.WordBoundary:
+		p.consumeToken()
+		node := &ast.WordBoundaryNode{Kind: t.Kind}
 		return node, nil
 	case *token.GroupingCloser:
 		return nil, fmt.Errorf("unmatched group closer")
@@ -161,11 +306,141 @@ func (p *Parser) parseAtom() (ast.ASTNode, error) {
 	}
 }
 
-func Parse(tokens []token.Token) (ast.ASTNode, int, error) {
-	parser := NewParser(tokens)
-	tree, err := parser.parseExpression()
+// newCharacterSetNode converts a bracket expression token, along with the
+// operands of its && and -- operators, into a node.
+func newCharacterSetNode(t *token.CharacterSet) *ast.CharacterSetNode {
+	node := &ast.CharacterSetNode{
+		IsPositive:        t.IsPositive,
+		Literals:          t.Literals,
+		Ranges:            t.Ranges,
+		CharacterClasses:  t.CharacterClasses,
+		UnicodeProperties: t.UnicodeProperties,
+	}
+	for _, operand := range t.Intersect {
+		node.Intersect = append(node.Intersect, newCharacterSetNode(operand))
+	}
+	for _, operand := range t.Subtract {
+		node.Subtract = append(node.Subtract, newCharacterSetNode(operand))
+	}
+	return node
+}
+
+// parseConditional parses the branches of a conditional group, up to its
+// closer. The group may have a single branch, which is then matched only
+// when the condition holds.
+func (p *Parser) parseConditional(opener *token.GroupingOpener) (ast.ASTNode, error) {
+	yes, err := p.parseBranch()
 	if err != nil {
+		return nil, err
+	}
+
+	var no ast.ASTNode = &ast.EmptyNode{}
+	if token.IsAlternation(p.currentToken()) {
+		p.consumeToken()
+		no, err = p.parseBranch()
+		if err != nil {
+			return nil, err
+		}
+		if token.IsAlternation(p.currentToken()) {
+			return nil, fmt.Errorf("conditional group has more than two branches")
+		}
+	}
+
+	node := &ast.ConditionalNode{
+		GroupIndex: opener.ConditionIndex,
+		Yes:        yes,
+		No:         no,
+	}
+	if opener.ConditionName != "" {
+		p.namedConditions[node] = opener.ConditionName
+	}
+	p.conditionals = append(p.conditionals, node)
+	return node, nil
+}
+
+// parseBranch parses one branch of a conditional group, which may be empty.
+func (p *Parser) parseBranch() (ast.ASTNode, error) {
+	switch t := p.currentToken(); {
+	case t == nil, token.IsAlternation(t), token.IsGroupingCloser(t):
+		return &ast.EmptyNode{}, nil
+	default:
+		return p.parseTerm()
+	}
+}
+
+// resolveNamedReferences points every \k<name> reference, named condition
+// and named subroutine call at the index of the group with that name.
+func (p *Parser) resolveNamedReferences() error {
+	for node, name := range p.namedReferences {
+		groupIndex, ok := p.groupNames[name]
+		if !ok {
+			return fmt.Errorf("reference to non-existent group name %q", name)
+		}
+		node.GroupIndex = groupIndex
+	}
+	for node, name := range p.namedConditions {
+		groupIndex, ok := p.groupNames[name]
+		if !ok {
+			return fmt.Errorf("condition on non-existent group name %q", name)
+		}
+		node.GroupIndex = groupIndex
+	}
+	for node, name := range p.namedCalls {
+		groupIndex, ok := p.groupNames[name]
+		if !ok {
+			return fmt.Errorf("call to non-existent group name %q", name)
+		}
+		node.GroupIndex = groupIndex
+	}
+	return nil
+}
+
+// validateReferences checks that every backreference, condition and
+// subroutine call points at a group that exists somewhere in the pattern.
+// Only calls may use group 0, which stands for the whole pattern.
+func (p *Parser) validateReferences() error {
+	for _, node := range p.references {
+		if node.GroupIndex < 1 || node.GroupIndex > p.captureIndex {
+			return fmt.Errorf("reference to non-existent group %d", node.GroupIndex)
+		}
+	}
+	for _, node := range p.conditionals {
+		if node.GroupIndex < 1 || node.GroupIndex > p.captureIndex {
+			return fmt.Errorf("condition on non-existent group %d", node.GroupIndex)
+		}
+	}
+	for _, node := range p.calls {
+		if node.GroupIndex > p.captureIndex {
+			return fmt.Errorf("call to non-existent group %d", node.GroupIndex)
+		}
+	}
+	return nil
+}
+
+// Parse builds the AST for the parser's tokens. It returns the number of
+// capture slots the pattern needs, including slot 0 for the whole match.
+// The indices of named groups are available from GroupNames afterwards. An
+// empty pattern matches the empty string, and so every line.
+func (p *Parser) Parse() (ast.ASTNode, int, error) {
+	if len(p.tokens) == 0 {
+		return &ast.EmptyNode{}, 1, nil
+	}
+	tree, err := p.parseExpression()
+	if err != nil {
+		return nil, 0, err
+	}
+	if p.currentToken() != nil {
+		return nil, 0, fmt.Errorf("unmatched group closer")
+	}
+	if err := p.resolveNamedReferences(); err != nil {
 		return nil, 0, err
 	}
-	return tree, parser.captureIndex + 1, nil
+	if err := p.validateReferences(); err != nil {
+		return nil, 0, err
+	}
+	return tree, p.captureIndex + 1, nil
+}
+
+func Parse(tokens []token.Token) (ast.ASTNode, int, error) {
+	return NewParser(tokens).Parse()
 }
@@ -4,7 +4,9 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/mmarchesotti/build-your-own-grep/internal/anchor"
 	"github.com/mmarchesotti/build-your-own-grep/internal/ast"
+	"github.com/mmarchesotti/build-your-own-grep/internal/boundary"
 	"github.com/mmarchesotti/build-your-own-grep/internal/lexer"
 )
 
@@ -21,6 +23,15 @@ func concat(left, right ast.ASTNode) ast.ASTNode {
 func star(child ast.ASTNode) ast.ASTNode { return &ast.KleeneClosureNode{Child: child} }
 func plus(child ast.ASTNode) ast.ASTNode { return &ast.PositiveClosureNode{Child: child} }
 func opt(child ast.ASTNode) ast.ASTNode  { return &ast.OptionalNode{Child: child} }
+func lazyStar(child ast.ASTNode) ast.ASTNode {
+	return &ast.KleeneClosureNode{Child: child, Lazy: true}
+}
+func lazyOpt(child ast.ASTNode) ast.ASTNode {
+	return &ast.OptionalNode{Child: child, Lazy: true}
+}
+func rep(child ast.ASTNode, min, max int) ast.ASTNode {
+	return &ast.RepetitionNode{Child: child, Min: min, Max: max}
+}
 func cs(pos bool, lits []rune) ast.ASTNode {
 	return &ast.CharacterSetNode{IsPositive: pos, Literals: lits}
 }
@@ -29,6 +40,10 @@ func capg(index int, child ast.ASTNode) ast.ASTNode {
 	return &ast.CaptureGroupNode{GroupIndex: index, Child: child}
 }
 
+func atomic(child ast.ASTNode) ast.ASTNode { return &ast.AtomicGroupNode{Child: child} }
+
+func backref(index int) ast.ASTNode { return &ast.BackReferenceNode{GroupIndex: index} }
+
 // --- Main Test Function ---
 
 func TestParse(t *testing.T) {
@@ -97,6 +112,153 @@ func TestParse(t *testing.T) {
 			expected:      concat(concat(star(lit('a')), plus(lit('b'))), opt(lit('c'))),
 			expectedCount: 1,
 		},
+		{
+			name:          "bounded repetition",
+			input:         "ab{2,3}",
+			expected:      concat(lit('a'), rep(lit('b'), 2, 3)),
+			expectedCount: 1,
+		},
+		{
+			name:  "open-ended repetition on a group",
+			input: "(ab){1,}",
+			expected: rep(
+				capg(1, concat(lit('a'), lit('b'))),
+				1, -1,
+			),
+			expectedCount: 2,
+		},
+		{
+			name:          "lazy quantifiers",
+			input:         "a*?b??",
+			expected:      concat(lazyStar(lit('a')), lazyOpt(lit('b'))),
+			expectedCount: 1,
+		},
+		{
+			name:          "atomic group",
+			input:         "(?>ab|a)c",
+			expected:      concat(atomic(alt(concat(lit('a'), lit('b')), lit('a'))), lit('c')),
+			expectedCount: 1,
+		},
+		{
+			name:          "possessive quantifiers",
+			input:         "a*+b++",
+			expected:      concat(atomic(star(lit('a'))), atomic(plus(lit('b')))),
+			expectedCount: 1,
+		},
+		{
+			name:  "lookaround assertions",
+			input: "(?<=a)b(?!c)",
+			expected: concat(
+				concat(&ast.LookbehindNode{Child: lit('a')}, lit('b')),
+				&ast.LookaheadNode{Child: lit('c'), Negated: true},
+			),
+			expectedCount: 1,
+		},
+		{
+			name:  "word boundaries",
+			input: `\<a\b`,
+			expected: concat(
+				concat(&ast.WordBoundaryNode{Kind: boundary.WordStart}, lit('a')),
+				&ast.WordBoundaryNode{Kind: boundary.WordBoundary},
+			),
+			expectedCount: 1,
+		},
+		{
+			name:  "scoped inline flags",
+			input: "(?i)a(?-i:b)(?s).",
+			expected: concat(
+				concat(
+					&ast.LiteralNode{Literal: 'a', CaseInsensitive: true},
+					lit('b'),
+				),
+				&ast.WildcardNode{DotAll: true},
+			),
+			expectedCount: 1,
+		},
+		{
+			name:  "inline flags end with their group",
+			input: "((?m)^)$",
+			expected: concat(
+				&ast.CaptureGroupNode{
+					Child:      &ast.AnchorNode{Kind: anchor.LineStart},
+					GroupIndex: 1,
+				},
+				&ast.AnchorNode{Kind: anchor.TextEnd},
+			),
+			expectedCount: 2,
+		},
+		{
+			name:  "absolute anchors ignore multiline mode",
+			input: `(?m)\A^$\Z`,
+			expected: concat(
+				concat(
+					concat(
+						&ast.AnchorNode{Kind: anchor.TextStart},
+						&ast.AnchorNode{Kind: anchor.LineStart},
+					),
+					&ast.AnchorNode{Kind: anchor.LineEnd},
+				),
+				&ast.AnchorNode{Kind: anchor.TextEndBeforeNewline},
+			),
+			expectedCount: 1,
+		},
+		{
+			name:  "conditional with two branches",
+			input: "(a)(?(1)b|c)",
+			expected: concat(
+				&ast.CaptureGroupNode{Child: lit('a'), GroupIndex: 1},
+				&ast.ConditionalNode{GroupIndex: 1, Yes: lit('b'), No: lit('c')},
+			),
+			expectedCount: 2,
+		},
+		{
+			name:  "named conditional with one branch",
+			input: "(?<q>a)(?(<q>)b)",
+			expected: concat(
+				&ast.CaptureGroupNode{Child: lit('a'), GroupIndex: 1},
+				&ast.ConditionalNode{GroupIndex: 1, Yes: lit('b'), No: &ast.EmptyNode{}},
+			),
+			expectedCount: 2,
+		},
+		{
+			name:  "named subroutine call",
+			input: "(?<q>a)(?&q)(?R)",
+			expected: concat(
+				concat(
+					&ast.CaptureGroupNode{Child: lit('a'), GroupIndex: 1},
+					&ast.SubroutineCallNode{GroupIndex: 1},
+				),
+				&ast.SubroutineCallNode{GroupIndex: 0},
+			),
+			expectedCount: 2,
+		},
+		{
+			name:  "character set with operands",
+			input: "[a-z&&[^x]--y]",
+			expected: &ast.CharacterSetNode{
+				IsPositive: true,
+				Ranges:     [][2]rune{{'a', 'z'}},
+				Intersect: []*ast.CharacterSetNode{
+					{IsPositive: false, Literals: []rune{'x'}},
+				},
+				Subtract: []*ast.CharacterSetNode{
+					{IsPositive: true, Literals: []rune{'y'}},
+				},
+			},
+			expectedCount: 1,
+		},
+		{
+			name:          "empty pattern",
+			input:         "",
+			expected:      &ast.EmptyNode{},
+			expectedCount: 1,
+		},
+		{
+			name:          "trailing inline flags",
+			input:         "a(?i)",
+			expected:      concat(lit('a'), &ast.EmptyNode{}),
+			expectedCount: 1,
+		},
 		{
 			name:          "character set",
 			input:         "[abc]",
@@ -127,6 +289,33 @@ func TestParse(t *testing.T) {
 			),
 			expectedCount: 3,
 		},
+		{
+			name:  "non-capturing group",
+			input: "(?:ab)(c)",
+			expected: concat(
+				concat(lit('a'), lit('b')),
+				capg(1, lit('c')),
+			),
+			expectedCount: 2,
+		},
+		{
+			name:  "named group and named backreference",
+			input: "(?:x)(?<word>a)\\k<word>",
+			expected: concat(
+				concat(lit('x'), capg(1, lit('a'))),
+				backref(1),
+			),
+			expectedCount: 2,
+		},
+		{
+			name:  "named backreference before its group",
+			input: "\\k<late>(a)(?P<late>b)",
+			expected: concat(
+				concat(backref(2), capg(1, lit('a'))),
+				capg(2, lit('b')),
+			),
+			expectedCount: 3,
+		},
 	}
 
 	for _, tt := range tests {
@@ -155,3 +344,96 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+func TestGroupNames(t *testing.T) {
+	tokens, err := lexer.Tokenize(`(a)(?P<year>\d+)(?:-)(?<month>\d+)`)
+	if err != nil {
+		t.Fatalf("Tokenize() returned an unexpected error: %v", err)
+	}
+
+	p := NewParser(tokens)
+	if _, _, err := p.Parse(); err != nil {
+		t.Fatalf("Parse() returned an unexpected error: %v", err)
+	}
+
+	expected := map[string]int{"year": 2, "month": 3}
+	if !reflect.DeepEqual(p.GroupNames(), expected) {
+		t.Errorf("GroupNames() got %v, want %v", p.GroupNames(), expected)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{
+			name:  "duplicate group name",
+			input: "(?<a>x)(?<a>y)",
+			err:   `duplicate group name "a"`,
+		},
+		{
+			name:  "unknown group name",
+			input: "(a)\\k<b>",
+			err:   `reference to non-existent group name "b"`,
+		},
+		{
+			name:  "unknown group number",
+			input: `(a)\2`,
+			err:   "reference to non-existent group 2",
+		},
+		{
+			name:  "unknown multi-digit group number",
+			input: `(a)\10`,
+			err:   "reference to non-existent group 10",
+		},
+		{
+			name:  "conditional with three branches",
+			input: "(a)(?(1)b|c|d)",
+			err:   "conditional group has more than two branches",
+		},
+		{
+			name:  "conditional on unknown group number",
+			input: "(a)(?(2)b)",
+			err:   "condition on non-existent group 2",
+		},
+		{
+			name:  "conditional on unknown group name",
+			input: "(a)(?(<q>)b)",
+			err:   `condition on non-existent group name "q"`,
+		},
+		{
+			name:  "call to unknown group number",
+			input: "(a)(?2)",
+			err:   "call to non-existent group 2",
+		},
+		{
+			name:  "call to unknown group name",
+			input: "(a)(?&q)",
+			err:   `call to non-existent group name "q"`,
+		},
+		{
+			name:  "unmatched group closer",
+			input: "a)b",
+			err:   "unmatched group closer",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := lexer.Tokenize(tt.input)
+			if err != nil {
+				t.Fatalf("Tokenize() returned an unexpected error: %v", err)
+			}
+
+			_, _, err = Parse(tokens)
+			if err == nil {
+				t.Fatalf("Parse() expected error '%s', but got nil", tt.err)
+			}
+			if err.Error() != tt.err {
+				t.Errorf("Parse() expected error '%s', but got '%v'", tt.err, err)
+			}
+		})
+	}
+}
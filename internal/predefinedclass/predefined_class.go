@@ -1,10 +1,42 @@
 // Package predefinedclass defines the types of predefined character classes
 package predefinedclass
 
+import "unicode"
+
 type PredefinedClass int
 
 const (
 	ClassDigit PredefinedClass = iota
 	ClassAlphanumeric
 	ClassWhitespace
+	ClassNonDigit
+	ClassNonAlphanumeric
+	ClassNonWhitespace
+	ClassAlpha
+	ClassAlnum
+	ClassBlank
+	ClassCntrl
+	ClassGraph
+	ClassLower
+	ClassPrint
+	ClassPunct
+	ClassUpper
+	ClassXDigit
 )
+
+// UnicodeProperty names a Unicode general category or script, as in \p{Lu}
+// or \P{Greek}.
+type UnicodeProperty struct {
+	Name    string
+	Negated bool
+}
+
+// LookupUnicodeProperty returns the range table for a general category such
+// as "L" or "Lu", or for a script such as "Greek" or "Han".
+func LookupUnicodeProperty(name string) (*unicode.RangeTable, bool) {
+	if table, ok := unicode.Categories[name]; ok {
+		return table, true
+	}
+	table, ok := unicode.Scripts[name]
+	return table, ok
+}
@@ -1,10 +1,30 @@
 // Package token defines the types of tokens used when tokenizing an input
 package token
 
-import "github.com/mmarchesotti/build-your-own-grep/internal/predefinedclass"
+import (
+	"github.com/mmarchesotti/build-your-own-grep/internal/anchor"
+	"github.com/mmarchesotti/build-your-own-grep/internal/boundary"
+	"github.com/mmarchesotti/build-your-own-grep/internal/inlineflag"
+	"github.com/mmarchesotti/build-your-own-grep/internal/predefinedclass"
+)
 
 type TokenType string
 
+// GroupKind distinguishes the different kinds of group a GroupingOpener can
+// start.
+type GroupKind int
+
+const (
+	GroupCapturing GroupKind = iota
+	GroupNonCapturing
+	GroupAtomic
+	GroupLookahead
+	GroupNegativeLookahead
+	GroupLookbehind
+	GroupNegativeLookbehind
+	GroupConditional
+)
+
 // --- Helper Functions ---
 
 func IsAlternation(t Token) bool {
@@ -17,6 +37,16 @@ func IsGroupingOpener(t Token) bool {
 	return ok
 }
 
+func IsBackReference(t Token) bool {
+	_, ok := t.(*BackReference)
+	return ok
+}
+
+func IsSubroutineCall(t Token) bool {
+	_, ok := t.(*SubroutineCall)
+	return ok
+}
+
 func IsGroupingCloser(t Token) bool {
 	_, ok := t.(*GroupingCloser)
 	return ok
@@ -25,7 +55,9 @@ func IsGroupingCloser(t Token) bool {
 func CanConcatenate(t Token) bool {
 	switch t.(type) {
 	case *Literal, *CharacterSet, *Wildcard, *Digit, *AlphaNumeric,
-		*StartAnchor, *EndAnchor, *GroupingOpener:
+		*Whitespace, *NonDigit, *NonAlphaNumeric, *NonWhitespace, *UnicodeClass,
+		*StartAnchor, *EndAnchor, *Anchor, *WordBoundary, *GroupingOpener, *BackReference,
+		*SubroutineCall, *InlineFlags:
 		return true
 	default:
 		return false
@@ -34,7 +66,7 @@ func CanConcatenate(t Token) bool {
 
 func IsUnaryOperator(t Token) bool {
 	switch t.(type) {
-	case *OptionalQuantifier, *KleeneClosure, *PositiveClosure:
+	case *OptionalQuantifier, *KleeneClosure, *PositiveClosure, *RepetitionQuantifier:
 		return true
 	default:
 		return false
@@ -43,7 +75,8 @@ func IsUnaryOperator(t Token) bool {
 
 func IsAtom(t Token) bool {
 	switch t.(type) {
-	case *Literal, *CharacterSet, *Wildcard, *Digit, *AlphaNumeric:
+	case *Literal, *CharacterSet, *Wildcard, *Digit, *AlphaNumeric,
+		*Whitespace, *NonDigit, *NonAlphaNumeric, *NonWhitespace, *UnicodeClass:
 		return true
 	default:
 		return false
@@ -65,31 +98,116 @@ func (token *baseToken) getType() string {
 }
 
 type (
-	Concatenation      struct{ baseToken }
-	KleeneClosure      struct{ baseToken }
-	PositiveClosure    struct{ baseToken }
-	OptionalQuantifier struct{ baseToken }
-	Alternation        struct{ baseToken }
-	StartAnchor        struct{ baseToken }
-	EndAnchor          struct{ baseToken }
-	Wildcard           struct{ baseToken }
-	GroupingOpener     struct{ baseToken }
-	GroupingCloser     struct{ baseToken }
-	Digit              struct{ baseToken }
-	AlphaNumeric       struct{ baseToken }
-	Literal            struct {
+	Concatenation   struct{ baseToken }
+	Alternation     struct{ baseToken }
+	StartAnchor     struct{ baseToken }
+	EndAnchor       struct{ baseToken }
+	Wildcard        struct{ baseToken }
+	GroupingCloser  struct{ baseToken }
+	Digit           struct{ baseToken }
+	AlphaNumeric    struct{ baseToken }
+	Whitespace      struct{ baseToken }
+	NonDigit        struct{ baseToken }
+	NonAlphaNumeric struct{ baseToken }
+	NonWhitespace   struct{ baseToken }
+	Literal         struct {
 		baseToken
 		Literal rune
 	}
+	// CharacterSet is a bracket expression. A rune is in the set if it is
+	// one of the members, in every set in Intersect and in none of the
+	// sets in Subtract, which come from the && and -- operators. When
+	// IsPositive is false the set matches the runes that are not in it.
 	CharacterSet struct {
 		baseToken
-		IsPositive       bool
-		Literals         []rune
-		Ranges           [][2]rune
-		CharacterClasses []predefinedclass.PredefinedClass
+		IsPositive        bool
+		Literals          []rune
+		Ranges            [][2]rune
+		CharacterClasses  []predefinedclass.PredefinedClass
+		UnicodeProperties []predefinedclass.UnicodeProperty
+		Intersect         []*CharacterSet
+		Subtract          []*CharacterSet
+	}
+	// Anchor is one of the \A, \z and \Z anchors, which ignore multiline
+	// mode. The meaning of ^ and $ depends on it, so they have their own
+	// StartAnchor and EndAnchor tokens.
+	Anchor struct {
+		baseToken
+		Kind anchor.Anchor
+	}
+	// WordBoundary is one of the \b, \B, \< and \> assertions.
+	WordBoundary struct {
+		baseToken
+		Kind boundary.Boundary
 	}
+	// UnicodeClass is a \p{Name} or negated \P{Name} property class.
+	UnicodeClass struct {
+		baseToken
+		Name    string
+		Negated bool
+	}
+	// GroupingOpener starts a group. Name is set for named capture groups
+	// such as (?P<name>...) and (?<name>...). FlagsOn and FlagsOff hold the
+	// modifiers of a (?flags:...) group, which only apply inside it. A
+	// conditional (?(1)...) or (?(<name>)...) tests the group in
+	// ConditionIndex or ConditionName.
+	GroupingOpener struct {
+		baseToken
+		Kind           GroupKind
+		Name           string
+		FlagsOn        inlineflag.Flags
+		FlagsOff       inlineflag.Flags
+		ConditionIndex int
+		ConditionName  string
+	}
+	// InlineFlags is a (?flags) modifier such as (?i) or (?m-s). It applies
+	// to the rest of the enclosing group.
+	InlineFlags struct {
+		baseToken
+		On  inlineflag.Flags
+		Off inlineflag.Flags
+	}
+	// BackReference refers to a capture group by index, or by Name for
+	// \k<name> references that the parser resolves to an index.
 	BackReference struct {
 		baseToken
 		CaptureIndex int
+		Name         string
+	}
+	// SubroutineCall matches the subpattern of the capture group
+	// GroupIndex at this point, as if it were written here. Group 0 is the
+	// whole pattern, as in (?R). Name is set for (?&name) and (?P>name)
+	// calls, which the parser resolves to an index.
+	SubroutineCall struct {
+		baseToken
+		GroupIndex int
+		Name       string
+	}
+	// The quantifiers are greedy unless Lazy is set by a trailing '?', as
+	// in *?, +?, ?? and {n,m}?. A trailing '+' sets Possessive instead, as
+	// in *+, ++, ?+ and {n,m}+.
+	KleeneClosure struct {
+		baseToken
+		Lazy       bool
+		Possessive bool
+	}
+	PositiveClosure struct {
+		baseToken
+		Lazy       bool
+		Possessive bool
+	}
+	OptionalQuantifier struct {
+		baseToken
+		Lazy       bool
+		Possessive bool
+	}
+	// RepetitionQuantifier is a counted repetition such as {n}, {n,} or
+	// {n,m}. Max is -1 when the repetition has no upper bound.
+	RepetitionQuantifier struct {
+		baseToken
+		Min        int
+		Max        int
+		Lazy       bool
+		Possessive bool
 	}
 )